@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// only one change through the admin api is handled at a time
+	adminlock sync.Mutex
+)
+
+// adminstate holds the changes made through the admin api. a nil value means
+// the alias or mirror was deleted, even if it is in the configuration file.
+// states only hold the state of a mirror, so the rest of its configuration
+// keeps following the configuration file.
+type adminstate struct {
+	Aliases map[string]*string       `yaml:"aliases"`
+	Mirrors map[string]*mirrorconfig `yaml:"mirrors"`
+	States  map[string]string        `yaml:"states"`
+}
+
+type auditentry struct {
+	Time   time.Time   `json:"time"`
+	Caller string      `json:"caller"`
+	Remote string      `json:"remote"`
+	Action string      `json:"action"`
+	Kind   string      `json:"kind"`
+	ID     string      `json:"id"`
+	Old    interface{} `json:"old"`
+	New    interface{} `json:"new"`
+	Error  string      `json:"error,omitempty"` // set when the change was not made after all
+}
+
+// readState reads the admin state from disk. a state file which does not
+// exist (yet) is the same as an empty one.
+func readState(filename string) (st *adminstate, err error) {
+	st = &adminstate{}
+	if filename != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(filename); err == nil {
+			if err = yaml.UnmarshalStrict(b, st); err != nil {
+				err = fmt.Errorf("unable to parse %s (%s)", filename, err.Error())
+				return
+			}
+		} else if !os.IsNotExist(err) {
+			err = fmt.Errorf("unable to read %s (%s)", filename, err.Error())
+			return
+		}
+		err = nil
+	}
+
+	if st.Aliases == nil {
+		st.Aliases = make(map[string]*string)
+	}
+	if st.Mirrors == nil {
+		st.Mirrors = make(map[string]*mirrorconfig)
+	}
+	if st.States == nil {
+		st.States = make(map[string]string)
+	}
+	return
+}
+
+// write stores the admin state by writing a temporary file first and moving
+// it in place, so a crash never leaves a half written state file behind.
+func (st *adminstate) write(filename string) (err error) {
+	var b []byte
+	if b, err = yaml.Marshal(st); err != nil {
+		return
+	}
+
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("unable to write %s (%s)", tmp, err.Error())
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("unable to replace %s (%s)", filename, err.Error())
+	}
+	return
+}
+
+// apply puts the changes from the admin state on top of the configuration.
+func (st *adminstate) apply(cfg *config) {
+	for name, release := range st.Aliases {
+		if release == nil {
+			delete(cfg.Aliases, name)
+		} else {
+			cfg.Aliases[name] = *release
+		}
+	}
+
+	seen := make(map[string]bool)
+	merged := make([]mirrorconfig, 0, len(cfg.Mirrors))
+	for _, mc := range cfg.Mirrors {
+		id := mirrorid(mc)
+		seen[id] = true
+		if override, found := st.Mirrors[id]; !found {
+			merged = append(merged, mc)
+		} else if override != nil {
+			merged = append(merged, *override)
+		}
+	}
+
+	// mirrors only known through the admin api are added at the end, sorted
+	// by id so the order does not change between restarts
+	var added []string
+	for id, mc := range st.Mirrors {
+		if !seen[id] && mc != nil {
+			added = append(added, id)
+		}
+	}
+	sort.Strings(added)
+	for _, id := range added {
+		merged = append(merged, *st.Mirrors[id])
+	}
+
+	for i := range merged {
+		if state, found := st.States[mirrorid(merged[i])]; found {
+			merged[i].State = state
+		}
+	}
+
+	cfg.Mirrors = merged
+}
+
+// mirrorid returns how a mirror is identified, which is its name or its url
+// if it has no name.
+func mirrorid(mc mirrorconfig) string {
+	if mc.Name != "" {
+		return mc.Name
+	}
+	return strings.TrimRight(strings.TrimSpace(mc.URL), "/")
+}
+
+// findMirror returns the mirror with the given id. as paths with "//" are
+// cleaned up before they reach the admin api, mirrors identified by their url
+// can also be found by their url without the scheme.
+func findMirror(mirrors []mirrorconfig, id string) (mc *mirrorconfig) {
+	for i := range mirrors {
+		mid := mirrorid(mirrors[i])
+		if p := strings.Index(mid, "://"); p >= 0 && mid[p+3:] == id {
+			mid = id
+		}
+		if mid == id {
+			return &mirrors[i]
+		}
+	}
+	return
+}
+
+// audit appends an entry to the audit log.
+func audit(filename string, e auditentry) (err error) {
+	var b []byte
+	if b, err = json.Marshal(e); err != nil {
+		return
+	}
+
+	var fh *os.File
+	if fh, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return fmt.Errorf("unable to open audit log %s (%s)", filename, err.Error())
+	}
+	defer fh.Close()
+
+	if _, err = fh.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("unable to write audit log %s (%s)", filename, err.Error())
+	}
+	return
+}
+
+// authenticate returns the name of the caller belonging to the bearer token
+// in the request, or an empty string if there is none.
+func authenticate(lc *liveconfig, r *http.Request) (caller string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return
+	}
+	for name, t := range lc.Admin.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			caller = name
+		}
+	}
+	return
+}
+
+func adminRequest(w http.ResponseWriter, r *http.Request) {
+	lc := current()
+
+	// without any tokens the admin api is disabled altogether
+	if len(lc.Admin.Tokens) < 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	caller := authenticate(lc, r)
+	if caller == "" {
+		warn("unauthorized admin request", "client", r.RemoteAddr, "uri", r.RequestURI)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/admin/"), "/", 2)
+	kind, id := p[0], ""
+	if len(p) > 1 {
+		id = p[1]
+	}
+
+	// webhooks can only be tested, by sending them a ping
+	if kind == "webhooks" && strings.HasSuffix(id, "/test") {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		webhookRequest(w, r, lc, strings.TrimSuffix(id, "/test"))
+		return
+	}
+
+	if kind != "aliases" && kind != "mirrors" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the state of a mirror can be changed on its own, to drain or disable
+	// a mirror without having to send its whole configuration
+	if kind == "mirrors" && strings.HasSuffix(id, "/state") {
+		kind, id = "states", strings.TrimSuffix(id, "/state")
+	}
+
+	switch {
+	case r.Method == http.MethodGet:
+		adminGet(w, lc, kind, id)
+	case r.Method == http.MethodPut && id != "",
+		r.Method == http.MethodDelete && id != "":
+		adminChange(w, r, caller, kind, id)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func adminGet(w http.ResponseWriter, lc *liveconfig, kind, id string) {
+	if kind == "aliases" {
+		if id == "" {
+			writeJSON(w, http.StatusOK, lc.aliases)
+		} else if release, found := lc.aliases[id]; found {
+			writeJSON(w, http.StatusOK, map[string]string{"name": id, "release": release})
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
+	if id == "" {
+		writeJSON(w, http.StatusOK, lc.Mirrors)
+		return
+	}
+	if mc := findMirror(lc.Mirrors, id); mc == nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else if kind == "states" {
+		writeJSON(w, http.StatusOK, map[string]string{"name": mirrorid(*mc), "state": mc.State})
+	} else {
+		writeJSON(w, http.StatusOK, mc)
+	}
+}
+
+// adminChange reloads the configuration with a single change and, if the
+// resulting configuration is valid, writes it to the audit log and the state
+// file before putting it to use. nothing changes if any of that fails.
+func adminChange(w http.ResponseWriter, r *http.Request, caller, kind, id string) {
+	adminlock.Lock()
+	defer adminlock.Unlock()
+
+	lc := current()
+	filename := lc.Admin.StateFile
+
+	st, err := readState(filename)
+	if err != nil {
+		warn("unable to read admin state", "err", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	e := auditentry{
+		Time:   time.Now(),
+		Caller: caller,
+		Remote: r.RemoteAddr,
+		Action: strings.ToLower(r.Method),
+		Kind:   map[string]string{"aliases": "alias", "mirrors": "mirror", "states": "mirror state"}[kind],
+		ID:     id,
+	}
+
+	if kind == "aliases" {
+		if old, found := lc.aliases[id]; found {
+			e.Old = old
+		}
+		if r.Method == http.MethodDelete {
+			if e.Old == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			st.Aliases[id] = nil
+		} else {
+			var body struct {
+				Release string `yaml:"release"`
+			}
+			if err = decodeBody(w, r, &body); err != nil || body.Release == "" {
+				warn("invalid admin request", "caller", caller, "kind", kind, "id", id)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			st.Aliases[id] = &body.Release
+			e.New = body.Release
+		}
+	} else if kind == "states" {
+		mc := findMirror(lc.Mirrors, id)
+		if mc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id = mirrorid(*mc)
+		e.ID, e.Old = id, mc.State
+		if r.Method == http.MethodDelete {
+			// the mirror goes back to the state from its configuration
+			if _, found := st.States[id]; !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(st.States, id)
+		} else {
+			var body struct {
+				State string `yaml:"state"`
+			}
+			if err = decodeBody(w, r, &body); err != nil || body.State == "" {
+				warn("invalid admin request", "caller", caller, "kind", kind, "id", id)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			st.States[id] = body.State
+			e.New = body.State
+		}
+	} else {
+		if mc := findMirror(lc.Mirrors, id); mc != nil {
+			e.Old = *mc
+			id = mirrorid(*mc)
+			e.ID = id
+		}
+		// a mirror which is replaced or removed as a whole no longer keeps a
+		// state set on its own
+		delete(st.States, id)
+		if r.Method == http.MethodDelete {
+			if e.Old == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			st.Mirrors[id] = nil
+		} else {
+			var mc mirrorconfig
+			if err = decodeBody(w, r, &mc); err != nil {
+				warn("invalid admin request", "caller", caller, "kind", kind, "id", id, "err", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if old, ok := e.Old.(mirrorconfig); !ok || old.Name != old.URL {
+				mc.Name = id
+			} else if mirrorid(mc) != id {
+				// a mirror identified by its url keeps being identified by it
+				warn("invalid admin request", "caller", caller, "kind", kind, "id", id, "err", "url differs from id")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			st.Mirrors[id] = &mc
+			e.New = mc
+		}
+	}
+
+	// a change which can not be audited is not made at all, and one which
+	// was audited but could not be stored gets a second entry saying so
+	var committed bool
+	if committed, err = reloadConfigWith(st, func() (err error) {
+		if err = audit(lc.Admin.AuditLog, e); err != nil {
+			return
+		}
+		if err = st.write(filename); err != nil {
+			e.Time, e.Error = time.Now(), err.Error()
+			if aerr := audit(lc.Admin.AuditLog, e); aerr != nil {
+				warn("unable to audit failed admin change", "caller", caller, "kind", kind, "id", id, "err", aerr.Error())
+			}
+		}
+		return
+	}); committed && err != nil {
+		warn("unable to commit admin change", "caller", caller, "kind", kind, "id", id, "err", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		warn("admin change rejected", "caller", caller, "kind", kind, "id", id, "err", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	info("admin change", "caller", e.Caller, "action", e.Action, "kind", e.Kind, "id", e.ID)
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+	} else if kind == "aliases" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": id, "release": e.New})
+	} else if kind == "states" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": id, "state": e.New})
+	} else {
+		writeJSON(w, http.StatusOK, e.New)
+	}
+}
+
+// decodeBody reads a request body as YAML, which also takes care of JSON.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) (err error) {
+	var b []byte
+	if b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16)); err != nil {
+		return
+	}
+	return yaml.UnmarshalStrict(b, v)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// advisory is an erratum from updateinfo.xml, trimmed down to what is needed
+// to tell what it is about.
+type advisory struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Severity string   `json:"severity,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Issued   string   `json:"issued,omitempty"`
+	CVEs     []string `json:"cves,omitempty"`
+	Packages []string `json:"packages"`
+}
+
+type updateinfo struct {
+	Type     string `xml:"type,attr"`
+	ID       string `xml:"id"`
+	Title    string `xml:"title"`
+	Severity string `xml:"severity"`
+	Issued   struct {
+		Date string `xml:"date,attr"`
+	} `xml:"issued"`
+	References []struct {
+		ID   string `xml:"id,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"references>reference"`
+	Packages []struct {
+		Name    string `xml:"name,attr"`
+		Epoch   string `xml:"epoch,attr"`
+		Version string `xml:"version,attr"`
+		Release string `xml:"release,attr"`
+		Arch    string `xml:"arch,attr"`
+	} `xml:"pkglist>collection>package"`
+}
+
+func (u updateinfo) advisory() (a advisory) {
+	a = advisory{
+		ID:       u.ID,
+		Type:     u.Type,
+		Severity: u.Severity,
+		Title:    u.Title,
+		Issued:   u.Issued.Date,
+		Packages: make([]string, 0, len(u.Packages)),
+	}
+	for _, r := range u.References {
+		if r.Type == "cve" {
+			a.CVEs = append(a.CVEs, r.ID)
+		}
+	}
+	for _, p := range u.Packages {
+		a.Packages = append(a.Packages, nevra{Name: p.Name, Epoch: p.Epoch, Version: p.Version, Release: p.Release, Arch: p.Arch}.String())
+	}
+	return
+}
+
+// hasData returns whether repomd.xml lists metadata of a type.
+func hasData(rmd *repomd, datatype string) bool {
+	for _, d := range rmd.Data {
+		if d.Type == datatype {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchAdvisories reads updateinfo.xml of a repo one update at a time, and
+// calls each for every one of them. a repo without updateinfo simply has no
+// advisories.
+func fetchAdvisories(lc *liveconfig, uri string, each func(u updateinfo)) (err error) {
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil || !hasData(rmd, "updateinfo") {
+		return
+	}
+
+	var rc io.ReadCloser
+	if rc, err = openData(lc, uri, rmd, "updateinfo"); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	dec := xml.NewDecoder(rc)
+	for {
+		var tok xml.Token
+		if tok, err = dec.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read updateinfo.xml (%s)", err.Error())
+		}
+
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "update" {
+			var u updateinfo
+			if err = dec.DecodeElement(&u, &se); err != nil {
+				return fmt.Errorf("unable to read updateinfo.xml (%s)", err.Error())
+			}
+			each(u)
+		}
+	}
+}
+
+// addAdvisories fills in the advisories which the new release of a diff has,
+// and the old release does not.
+func addAdvisories(lc *liveconfig, diff *repodiff) (err error) {
+	old := make(map[string]bool)
+	if err = fetchAdvisories(lc, diff.olduri, func(u updateinfo) {
+		old[u.ID] = true
+	}); err != nil {
+		return
+	}
+
+	advisories := make([]advisory, 0)
+	if err = fetchAdvisories(lc, diff.newuri, func(u updateinfo) {
+		if !old[u.ID] {
+			advisories = append(advisories, u.advisory())
+		}
+	}); err != nil {
+		return
+	}
+
+	sort.Slice(advisories, func(i, j int) bool {
+		return advisories[i].ID < advisories[j].ID
+	})
+
+	diff.advisories = advisories
+	diff.hasadvisories = true
+	return
+}
+
+// filterAdvisories returns the advisories of the kind asked for, which is
+// either all of them or only the security advisories.
+func filterAdvisories(advisories []advisory, kind string) (filtered []advisory) {
+	filtered = make([]advisory, 0, len(advisories))
+	for _, a := range advisories {
+		if kind != "security" || a.Type == "security" {
+			filtered = append(filtered, a)
+		}
+	}
+	return
+}
+
+// formatAdvisory returns an advisory as a line of a repodiff followed by the
+// packages it affects.
+func formatAdvisory(a advisory) (s string) {
+	s = "* " + a.ID + " (" + a.Type
+	if len(a.Severity) > 0 {
+		s += ", " + a.Severity
+	}
+	s += ")"
+	if len(a.CVEs) > 0 {
+		s += " " + strings.Join(a.CVEs, " ")
+	}
+	s += "\n"
+	for _, p := range a.Packages {
+		s += "    " + p + "\n"
+	}
+	return
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// holds a map[string]ruleresult with the latest resolution of every rule
+	ruleresults atomic.Value
+
+	// matches the links to directories in a mirror index page
+	indexlink = regexp.MustCompile(`href="([^"?#]+)/"`)
+
+	// wakes up watchRules to evaluate the rules right away
+	rulesagain = make(chan struct{}, 1)
+)
+
+// aliasrule is an alias which is not pointed at a fixed release, but at the
+// newest (or second-newest, etc.) release matching a pattern which enough
+// mirrors have.
+type aliasrule struct {
+	Name       string   `yaml:"name"`
+	Match      string   `yaml:"match"`       // pattern of releases to consider, like "7.*"
+	Rank       int      `yaml:"rank"`        // 1 is newest, 2 is second-newest, etc.
+	MinMirrors int      `yaml:"min_mirrors"` // mirrors which need to have a release
+	Repo       string   `yaml:"repo"`        // repo a release is probed for
+	Arch       string   `yaml:"arch"`
+	Candidates []string `yaml:"candidates"` // probe these instead of reading index pages
+}
+
+type ruleresult struct {
+	release   string
+	mirrors   int
+	lastcheck time.Time
+}
+
+func (ar *aliasrule) validate() error {
+	if ar.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	if _, err := path.Match(ar.Match, ""); err != nil || ar.Match == "" {
+		return fmt.Errorf("invalid match pattern %q", ar.Match)
+	}
+	if ar.Rank == 0 {
+		ar.Rank = 1
+	}
+	if ar.MinMirrors == 0 {
+		ar.MinMirrors = 1
+	}
+	if ar.Rank < 1 || ar.MinMirrors < 1 {
+		return fmt.Errorf("both rank and min_mirrors should be at least 1")
+	}
+	// a directory on an index page or a candidate is not a release yet,
+	// only a repo in it which can be probed makes it one
+	if len(ar.Repo) < 1 {
+		return fmt.Errorf("a repo is required to probe releases for")
+	}
+	return nil
+}
+
+// describe returns a short human readable version of the rule.
+func (ar *aliasrule) describe() (s string) {
+	switch ar.Rank {
+	case 1:
+		s = "newest"
+	case 2:
+		s = "second-newest"
+	default:
+		s = ordinal(ar.Rank) + "-newest"
+	}
+	s += " " + ar.Match + " on at least " + strconv.Itoa(ar.MinMirrors) + " mirror(s)"
+	return
+}
+
+// ordinal returns a number as 1st, 2nd, 3rd, 4th, etc.
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// resolveRule looks up a release an alias rule currently points to.
+func resolveRule(name string) (release string, found bool) {
+	if results, ok := ruleresults.Load().(map[string]ruleresult); ok {
+		var r ruleresult
+		if r, found = results[name]; found {
+			release = r.release
+		}
+	}
+	return
+}
+
+// listReleases fetches the index page of a mirror and returns all directories
+// on it matching the pattern.
+func listReleases(lc *liveconfig, m *mirrorsite, pattern string) (releases []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lc.Timeouts.Check)
+	defer cancel()
+
+	var req *http.Request
+	if req, err = http.NewRequest("GET", m.url+"/", nil); err != nil {
+		return
+	}
+
+	var resp *http.Response
+	if resp, err = m.client.Do(req.WithContext(ctx)); err != nil {
+		err = fmt.Errorf("unable to fetch index (%s)", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unable to fetch index (status %d)", resp.StatusCode)
+		return
+	}
+
+	var b []byte
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = fmt.Errorf("unable to read index (%s)", err.Error())
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, match := range indexlink.FindAllSubmatch(b, -1) {
+		release := path.Base(string(match[1]))
+		if ok, _ := path.Match(pattern, release); ok && !seen[release] {
+			seen[release] = true
+			releases = append(releases, release)
+		}
+	}
+	return
+}
+
+// evaluateRule discovers all releases on all mirrors and picks the one the
+// rule points to.
+func evaluateRule(lc *liveconfig, ar aliasrule) (result ruleresult, err error) {
+	count := make(map[string]int)
+	for _, m := range lc.mirrors {
+		if !m.checked("") {
+			continue
+		}
+		candidates := ar.Candidates
+		if len(candidates) < 1 {
+			var lerr error
+			if candidates, lerr = listReleases(lc, m, ar.Match); lerr != nil {
+				debug("unable to list releases", "mirror", m.name, "rule", ar.Name, "err", lerr.Error())
+				continue
+			}
+		}
+
+		for _, release := range candidates {
+			if ok, _ := path.Match(ar.Match, release); !ok {
+				continue
+			}
+			if !m.serves(release, ar.Repo) || !checkMirror(lc, m.uri(release, ar.Repo, ar.Arch)) {
+				continue
+			}
+			count[release]++
+		}
+	}
+
+	var releases []string
+	for release, n := range count {
+		if n >= ar.MinMirrors {
+			releases = append(releases, release)
+		}
+	}
+
+	// newest release first
+	sort.Slice(releases, func(i, j int) bool {
+		return rpmvercmp(releases[i], releases[j]) > 0
+	})
+
+	if len(releases) < ar.Rank {
+		err = fmt.Errorf("only %d release(s) found matching %s", len(releases), ar.describe())
+		return
+	}
+
+	result = ruleresult{
+		release:   releases[ar.Rank-1],
+		mirrors:   count[releases[ar.Rank-1]],
+		lastcheck: time.Now(),
+	}
+	return
+}
+
+// evaluateRules resolves all alias rules once. a rule which can not be
+// resolved keeps pointing to what it pointed to before.
+func evaluateRules() {
+	lc := current()
+	previous, _ := ruleresults.Load().(map[string]ruleresult)
+	results := make(map[string]ruleresult)
+
+	for _, ar := range lc.AliasRules {
+		if result, err := evaluateRule(lc, ar); err != nil {
+			warn("unable to resolve alias rule", "alias", ar.Name, "err", err.Error())
+			if old, found := previous[ar.Name]; found {
+				results[ar.Name] = old
+			}
+		} else {
+			if old, found := previous[ar.Name]; !found || old.release != result.release {
+				info("alias rule resolved", "alias", ar.Name, "release", result.release, "mirrors", result.mirrors)
+				if found {
+					notify(eventAliasChanged, map[string]interface{}{"alias": ar.Name, "release": result.release, "previous": old.release, "rule": ar.describe()})
+				}
+			}
+			results[ar.Name] = result
+		}
+	}
+
+	ruleresults.Store(results)
+}
+
+// watchRules re-evaluates the alias rules every interval, or when asked to by
+// reevaluateRules, until stop gets closed. all evaluations happen here, so they
+// never run at the same time.
+func watchRules(stop chan struct{}) {
+	for {
+		evaluateRules()
+		select {
+		case <-stop:
+			return
+		case <-rulesagain:
+		case <-time.After(current().TTL.Rules):
+		}
+	}
+}
+
+// reevaluateRules makes watchRules evaluate the alias rules right away, as
+// they might have changed.
+func reevaluateRules() {
+	select {
+	case rulesagain <- struct{}{}:
+	default:
+		// an evaluation is pending already
+	}
+}
+
+// aliasresult is what an alias currently points to.
+type aliasresult struct {
+	Name      string     `json:"name"`
+	Release   string     `json:"release"`
+	Rule      string     `json:"rule,omitempty"`
+	Mirrors   int        `json:"mirrors,omitempty"`
+	LastCheck *time.Time `json:"lastcheck,omitempty"`
+}
+
+func aliasesRequest(w http.ResponseWriter, r *http.Request) {
+	lc := current()
+
+	var names []string
+	for name := range lc.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]aliasresult, 0)
+	for _, name := range names {
+		results = append(results, aliasresult{Name: name, Release: lc.aliases[name]})
+	}
+
+	ruled, _ := ruleresults.Load().(map[string]ruleresult)
+	for _, ar := range lc.AliasRules {
+		result := aliasresult{Name: ar.Name, Rule: ar.describe()}
+		if rr, found := ruled[ar.Name]; found {
+			result.Release, result.Mirrors = rr.release, rr.mirrors
+			lastcheck := rr.lastcheck
+			result.LastCheck = &lastcheck
+		}
+		results = append(results, result)
+	}
+
+	switch outputFormat(r) {
+	case formatJSON:
+		writeJSON(w, http.StatusOK, results)
+	case formatCSV:
+		records := [][]string{{"name", "release", "rule", "mirrors", "lastcheck"}}
+		for _, a := range results {
+			var lastcheck string
+			if a.LastCheck != nil {
+				lastcheck = a.LastCheck.Format(time.RFC3339)
+			}
+			records = append(records, []string{a.Name, a.Release, a.Rule, strconv.Itoa(a.Mirrors), lastcheck})
+		}
+		writeCSV(w, http.StatusOK, records)
+	default:
+		var resp string
+		for _, a := range results {
+			if a.Rule == "" {
+				resp += a.Name + " " + a.Release + "\n"
+			} else if a.LastCheck == nil {
+				resp += a.Name + " UNRESOLVED (" + a.Rule + ")\n"
+			} else {
+				resp += a.Name + " " + a.Release + " (" + a.Rule + ", found on " + strconv.Itoa(a.Mirrors) + " mirror(s), checked " + time.Since(*a.LastCheck).Round(time.Second).String() + " ago)\n"
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(resp))
+	}
+}
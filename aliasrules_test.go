@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAliasRuleDescribe(t *testing.T) {
+	for rank, expect := range map[int]string{
+		1:   "newest",
+		2:   "second-newest",
+		3:   "3rd-newest",
+		4:   "4th-newest",
+		11:  "11th-newest",
+		12:  "12th-newest",
+		13:  "13th-newest",
+		21:  "21st-newest",
+		22:  "22nd-newest",
+		23:  "23rd-newest",
+		101: "101st-newest",
+		111: "111th-newest",
+	} {
+		ar := aliasrule{Match: "7.*", Rank: rank, MinMirrors: 2}
+		if got := ar.describe(); got != expect+" 7.* on at least 2 mirror(s)" {
+			t.Errorf("rank %d: %q, expected %s", rank, got, expect)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// changelogentry is a single entry from the changelog of a package, as found
+// in other.xml.
+type changelogentry struct {
+	Author string `xml:"author,attr" json:"author"`
+	Date   int64  `xml:"date,attr" json:"date"`
+	Text   string `xml:",chardata" json:"text"`
+}
+
+type otherpkg struct {
+	PkgID     string           `xml:"pkgid,attr"`
+	Changelog []changelogentry `xml:"changelog"`
+}
+
+// fetchChangelogs reads other.xml of a repo and returns the changelogs of the
+// packages asked for by their pkgid (checksum). the document is read one
+// package at a time, skipping the packages nobody asked for.
+func fetchChangelogs(lc *liveconfig, uri string, pkgids map[string]bool) (changelogs map[string][]changelogentry, err error) {
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
+		return
+	}
+
+	var rc io.ReadCloser
+	if rc, err = openData(lc, uri, rmd, "other"); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	changelogs = make(map[string][]changelogentry)
+	dec := xml.NewDecoder(rc)
+	for {
+		var tok xml.Token
+		if tok, err = dec.Token(); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			err = fmt.Errorf("unable to read other.xml (%s)", err.Error())
+			return
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "package" {
+			continue
+		}
+
+		var wanted bool
+		for _, a := range se.Attr {
+			if a.Name.Local == "pkgid" && pkgids[a.Value] {
+				wanted = true
+			}
+		}
+		if !wanted {
+			if err = dec.Skip(); err != nil {
+				err = fmt.Errorf("unable to read other.xml (%s)", err.Error())
+				return
+			}
+			continue
+		}
+
+		var p otherpkg
+		if err = dec.DecodeElement(&p, &se); err != nil {
+			err = fmt.Errorf("unable to read other.xml (%s)", err.Error())
+			return
+		}
+		changelogs[p.PkgID] = p.Changelog
+	}
+}
+
+// changelogEVR takes the epoch, version and release from the author of a
+// changelog entry, which by convention ends in " - [epoch:]version-release".
+// the release is optional, when there is no version found ok is false.
+func changelogEVR(author string) (epoch, ver, rel string, ok bool) {
+	i := strings.LastIndex(author, " ")
+	if i < 0 || strings.HasSuffix(author, ">") {
+		return
+	}
+	evr := author[i+1:]
+
+	epoch = "0"
+	if j := strings.Index(evr, ":"); j >= 0 {
+		epoch, evr = evr[:j], evr[j+1:]
+	}
+	if j := strings.LastIndex(evr, "-"); j >= 0 {
+		evr, rel = evr[:j], evr[j+1:]
+	}
+	ver = evr
+	ok = len(ver) > 0
+	return
+}
+
+// changesSince returns the changelog entries which are newer than a package
+// version, newest first.
+func changesSince(entries []changelogentry, since nevra) (newer []changelogentry) {
+	for _, e := range entries {
+		epoch, ver, rel, ok := changelogEVR(e.Author)
+		if !ok {
+			continue
+		}
+		if len(rel) < 1 {
+			// without a release only the version can be compared
+			if evrcmp(epoch, ver, "", since.Epoch, since.Version, "") > 0 {
+				newer = append(newer, e)
+			}
+		} else if evrcmp(epoch, ver, rel, since.Epoch, since.Version, since.Release) > 0 {
+			newer = append(newer, e)
+		}
+	}
+
+	sort.SliceStable(newer, func(i, j int) bool {
+		return newer[i].Date > newer[j].Date
+	})
+	return
+}
+
+// addChangelogs fills in the changelog of every changed package in a diff,
+// with the entries between the lower and the higher of both versions.
+func addChangelogs(lc *liveconfig, diff *repodiff) (err error) {
+	oldids := make(map[string]bool)
+	newids := make(map[string]bool)
+	for _, c := range diff.changed {
+		if c.Type == changeDowngrade {
+			oldids[c.Old.Checksum] = true
+		} else {
+			newids[c.New.Checksum] = true
+		}
+	}
+
+	var oldlogs, newlogs map[string][]changelogentry
+	if len(oldids) > 0 {
+		if oldlogs, err = fetchChangelogs(lc, diff.olduri, oldids); err != nil {
+			return
+		}
+	}
+	if len(newids) > 0 {
+		if newlogs, err = fetchChangelogs(lc, diff.newuri, newids); err != nil {
+			return
+		}
+	}
+
+	// the cached diff might be in use by other requests, so work on a copy
+	changed := make([]pkgchange, len(diff.changed))
+	copy(changed, diff.changed)
+	for i, c := range changed {
+		if c.Type == changeDowngrade {
+			changed[i].Changelog = changesSince(oldlogs[c.Old.Checksum], c.New)
+		} else {
+			changed[i].Changelog = changesSince(newlogs[c.New.Checksum], c.Old)
+		}
+	}
+
+	diff.changed = changed
+	diff.changelogs = true
+	return
+}
+
+// formatChangelog returns changelog entries the way rpm -q --changelog shows
+// them, indented to go below a line of a repodiff.
+func formatChangelog(entries []changelogentry) (s string) {
+	for _, e := range entries {
+		s += "    * " + time.Unix(e.Date, 0).UTC().Format("Mon Jan 02 2006") + " " + e.Author + "\n"
+		for _, line := range strings.Split(strings.TrimSpace(e.Text), "\n") {
+			s += "    " + line + "\n"
+		}
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// newChecksum returns a hash for a type of checksum as it is named in the
+// repo metadata.
+func newChecksum(kind string) (h hash.Hash, err error) {
+	switch strings.ToLower(kind) {
+	case "md5":
+		h = md5.New()
+	case "sha", "sha1":
+		h = sha1.New()
+	case "sha224":
+		h = sha256.New224()
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		err = fmt.Errorf("unknown checksum type %q", kind)
+	}
+	return
+}
+
+// sumOf returns the checksum of everything written to a hash so far, in the
+// same form as the repo metadata has it.
+func sumOf(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
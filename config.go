@@ -0,0 +1,631 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultConfigFile = "repogirl.yaml"
+
+// config is the structured configuration as read from the configuration
+// file. environment variables are applied on top of it as overrides.
+type config struct {
+	Mirrors []mirrorconfig    `yaml:"mirrors"`
+	Aliases map[string]string `yaml:"aliases"`
+
+	AliasRules []aliasrule `yaml:"alias_rules"`
+
+	Listen struct {
+		HTTP  string `yaml:"http"`
+		HTTPS string `yaml:"https"`
+	} `yaml:"listen"`
+
+	TTL struct {
+		Mirror     time.Duration `yaml:"mirror"`     // how long a mirror check is cached
+		Mirrorlist time.Duration `yaml:"mirrorlist"` // max-age sent along with mirrorlists
+		Repodiff   time.Duration `yaml:"repodiff"`   // max-age sent along with repodiffs
+		Rules      time.Duration `yaml:"rules"`      // how often alias rules are re-evaluated
+	} `yaml:"ttl"`
+
+	Timeouts struct {
+		Check    time.Duration `yaml:"check"`    // time a mirror gets to answer a check
+		Shutdown time.Duration `yaml:"shutdown"` // time given to servers to shut down
+		Idle     time.Duration `yaml:"idle"`     // interval for closing idle connections
+	} `yaml:"timeouts"`
+
+	FetchRoutines      int    `yaml:"fetch_routines"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	Proxy              string `yaml:"proxy"`
+	Debug              bool   `yaml:"debug"`
+	Metadata           string `yaml:"metadata"` // which package metadata to read, auto or xml
+
+	Jobs []jobconfig `yaml:"jobs"`
+
+	Feeds    []feedconfig `yaml:"feeds"`
+	FeedFile string       `yaml:"feed_file"` // where feed snapshots are kept across restarts, if anywhere
+
+	Webhooks []webhookconfig `yaml:"webhooks"`
+
+	GPG struct {
+		Keys    []string `yaml:"keys"`    // files with the public keys repos and packages should be signed with
+		Require bool     `yaml:"require"` // whether a repomd.xml without a signature fails
+	} `yaml:"gpg"`
+
+	DiffSources []string `yaml:"diff_sources"` // repos which may be diffed by uri, and everything below them
+
+	MetadataCache struct {
+		Packages int `yaml:"packages"` // how many packages of all repos together are cached at most, 0 turns the cache off
+	} `yaml:"metadata_cache"`
+
+	DiffCache struct {
+		Entries int    `yaml:"entries"` // how many repodiffs are cached at most
+		File    string `yaml:"file"`    // where repodiffs are kept across restarts, if anywhere
+	} `yaml:"diff_cache"`
+
+	Admin struct {
+		Tokens    map[string]string `yaml:"tokens"`     // caller name to bearer token
+		StateFile string            `yaml:"state_file"` // where changes made through the api are kept
+		AuditLog  string            `yaml:"audit_log"`  // where changes made through the api are logged
+	} `yaml:"admin"`
+}
+
+// mirrorconfig holds the per-mirror settings. anything left empty falls back
+// to the global setting.
+type mirrorconfig struct {
+	Name   string `yaml:"name" json:"name"`
+	URL    string `yaml:"url" json:"url"`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+	TLS    struct {
+		InsecureSkipVerify *bool  `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+		ClientCert         string `yaml:"client_cert,omitempty" json:"client_cert,omitempty"`
+		ClientKey          string `yaml:"client_key,omitempty" json:"client_key,omitempty"`
+	} `yaml:"tls,omitempty" json:"tls"`
+	Proxy         string   `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	FetchRoutines int      `yaml:"fetch_routines,omitempty" json:"fetch_routines,omitempty"`
+	Repos         []string `yaml:"repos,omitempty" json:"repos,omitempty"`
+	Releases      []string `yaml:"releases,omitempty" json:"releases,omitempty"`
+	State         string   `yaml:"state,omitempty" json:"state,omitempty"`
+}
+
+// states a mirror can be in, to take it out of rotation without removing it
+const (
+	stateActive     = "active"      // listed and used for everything
+	stateLastResort = "last-resort" // only listed when no active mirror has the repo
+	stateDrained    = "drained"     // never listed, but still used and checked
+	stateDisabled   = "disabled"    // never listed or used, only checked when asked for
+)
+
+// package metadata to read from repos
+const (
+	metadataAuto = "auto" // primary_db if a repo has one, primary.xml otherwise
+	metadataXML  = "xml"  // always primary.xml
+)
+
+// mirrorsite is a mirror as it is used at runtime, with its own http client
+// built from the mirrorconfig.
+type mirrorsite struct {
+	name     string
+	url      string
+	weight   int
+	routines int
+	repos    []string
+	releases []string
+	state    string
+	client   *http.Client
+}
+
+// serves returns whether this mirror should be asked for the release and repo.
+// empty lists of repos or releases mean the mirror carries all of them, and
+// entries may be shell patterns like "7.*".
+func (m *mirrorsite) serves(release, repo string) bool {
+	return matchany(m.releases, release) && matchany(m.repos, repo)
+}
+
+// uri returns where a repo can be found on this mirror.
+func (m *mirrorsite) uri(release, repo, arch string) (uri string) {
+	uri = m.url + "/" + release + "/" + repo
+	if len(arch) > 0 {
+		uri += "/" + arch
+	}
+	return
+}
+
+// listed returns whether the mirror may be handed out in mirrorlists at all.
+func (m *mirrorsite) listed() bool {
+	return m.state == stateActive || m.state == stateLastResort
+}
+
+// checked returns whether repohealth and repomirror (or anything else working
+// with the contents of a mirror) should use the mirror. maintenance is either
+// "include" to use all mirrors, "skip" to leave out both drained and disabled
+// mirrors, or empty to only leave out the disabled ones.
+func (m *mirrorsite) checked(maintenance string) bool {
+	switch maintenance {
+	case "include":
+		return true
+	case "skip":
+		return m.listed()
+	}
+	return m.state != stateDisabled
+}
+
+func matchany(patterns []string, s string) bool {
+	if len(patterns) < 1 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultConfig returns a config with all the values repogirl used before
+// there was a configuration file.
+func defaultConfig() (cfg *config) {
+	cfg = &config{}
+	cfg.Aliases = make(map[string]string)
+	cfg.Listen.HTTP = ":8080"
+	cfg.Listen.HTTPS = ":8443"
+	cfg.TTL.Mirror = time.Minute
+	cfg.TTL.Mirrorlist = time.Hour
+	cfg.TTL.Repodiff = time.Hour * 24
+	cfg.TTL.Rules = time.Minute * 15
+	cfg.Timeouts.Check = time.Second * 2
+	cfg.Timeouts.Shutdown = time.Second * 5
+	cfg.Timeouts.Idle = time.Second * 10
+	cfg.FetchRoutines = 16
+	cfg.Metadata = metadataAuto
+	cfg.MetadataCache.Packages = 50000
+	cfg.DiffCache.Entries = 256
+	cfg.Admin.StateFile = "repogirl-state.yaml"
+	cfg.Admin.AuditLog = "repogirl-audit.log"
+	return
+}
+
+// loadConfig reads the configuration file (if any), applies the environment
+// variables and changes made through the admin api on top of it and validates
+// the result.
+func loadConfig() (cfg *config, err error) {
+	return loadConfigWith(nil)
+}
+
+// loadConfigWith loads the configuration like loadConfig, but with the given
+// admin state instead of the one in the state file, if it is not nil.
+func loadConfigWith(st *adminstate) (cfg *config, err error) {
+	cfg = defaultConfig()
+
+	filename, set := os.LookupEnv("CONFIG_FILE")
+	if !set {
+		filename = defaultConfigFile
+	}
+
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); err == nil {
+		if err = yaml.UnmarshalStrict(b, cfg); err != nil {
+			err = fmt.Errorf("unable to parse %s (%s)", filename, err.Error())
+			return
+		}
+		info("loaded configuration file", "file", filename)
+	} else if set || !os.IsNotExist(err) {
+		// only complain about a missing file if one was explicitly asked for
+		err = fmt.Errorf("unable to read %s (%s)", filename, err.Error())
+		return
+	}
+
+	if err = cfg.applyEnv(); err != nil {
+		return
+	}
+
+	// changes made through the admin api are the most recent, so they are
+	// applied last
+	if st == nil {
+		if st, err = readState(cfg.Admin.StateFile); err != nil {
+			return
+		}
+	}
+	st.apply(cfg)
+
+	err = cfg.validate()
+	return
+}
+
+// applyEnv overrides the configuration with whatever is set in the
+// environment.
+func (cfg *config) applyEnv() error {
+	// parse repo mirrors from environment variable
+	if val, ok := os.LookupEnv("REPO_MIRRORS"); ok {
+		cfg.Mirrors = nil
+		for _, m := range strings.Split(val, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				cfg.Mirrors = append(cfg.Mirrors, mirrorconfig{URL: m})
+			}
+		}
+	}
+
+	// parse release aliases from environment variable
+	if val, ok := os.LookupEnv("RELEASE_ALIASES"); ok {
+		cfg.Aliases = make(map[string]string)
+		for _, a := range strings.Split(val, ",") {
+			a = strings.TrimSpace(a)
+			p := strings.Split(a, "=")
+			if len(p) != 2 {
+				return fmt.Errorf("could not parse release alias %q in RELEASE_ALIASES", a)
+			}
+			cfg.Aliases[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+		}
+	}
+
+	if val, set := os.LookupEnv("FETCH_ROUTINES"); set {
+		if v, err := strconv.Atoi(val); err != nil {
+			warn("unable to parse FETCH_ROUTINES", "got", val, "expect", "int")
+		} else {
+			cfg.FetchRoutines = v
+		}
+	}
+
+	if val, set := os.LookupEnv("DEBUG"); set {
+		// even if DEBUG is set, but the value is any of 0, no, or false,
+		// then still do not enable debug output.
+		cfg.Debug = !isfalse(val)
+	}
+
+	if val, set := os.LookupEnv("INSECURE_SKIP_VERIFY"); set {
+		// even if INSECURE_SKIP_VERIFY is set, but the value is any of
+		// 0, no, or false, then still do not disable verification.
+		cfg.InsecureSkipVerify = !isfalse(val)
+	}
+
+	if val, set := os.LookupEnv("HTTP_PROXY"); set {
+		cfg.Proxy = val
+	}
+
+	return nil
+}
+
+func isfalse(val string) bool {
+	switch strings.ToLower(val) {
+	case "0", "no", "false":
+		return true
+	}
+	return false
+}
+
+// validate checks the configuration for anything that would only blow up
+// later on, so startup can fail with a clear message instead.
+func (cfg *config) validate() error {
+	names := make(map[string]bool)
+	for i := range cfg.Mirrors {
+		m := &cfg.Mirrors[i]
+		m.URL = strings.TrimRight(strings.TrimSpace(m.URL), "/")
+		if u, err := url.Parse(m.URL); err != nil {
+			return fmt.Errorf("mirror %d: invalid url %q (%s)", i+1, m.URL, err.Error())
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("mirror %d: url %q should start with http:// or https://", i+1, m.URL)
+		} else if u.Host == "" {
+			return fmt.Errorf("mirror %d: url %q has no host", i+1, m.URL)
+		}
+		if m.Name == "" {
+			m.Name = m.URL
+		}
+		if names[m.Name] {
+			return fmt.Errorf("mirror %d: duplicate name %q", i+1, m.Name)
+		}
+		names[m.Name] = true
+		if m.Weight < 0 {
+			return fmt.Errorf("mirror %q: weight can not be negative", m.Name)
+		}
+		switch m.State {
+		case "":
+			m.State = stateActive
+		case stateActive, stateLastResort, stateDrained, stateDisabled:
+		default:
+			return fmt.Errorf("mirror %q: state should be one of %s, %s, %s or %s, got %q", m.Name, stateActive, stateLastResort, stateDrained, stateDisabled, m.State)
+		}
+		if m.FetchRoutines < 0 {
+			return fmt.Errorf("mirror %q: fetch_routines can not be negative", m.Name)
+		}
+		if (m.TLS.ClientCert == "") != (m.TLS.ClientKey == "") {
+			return fmt.Errorf("mirror %q: both client_cert and client_key are needed for client-TLS", m.Name)
+		}
+		if m.Proxy != "" {
+			if _, err := url.Parse(m.Proxy); err != nil {
+				return fmt.Errorf("mirror %q: invalid proxy %q (%s)", m.Name, m.Proxy, err.Error())
+			}
+		}
+		for _, p := range append(append([]string{}, m.Repos...), m.Releases...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("mirror %q: invalid pattern %q (%s)", m.Name, p, err.Error())
+			}
+		}
+	}
+
+	for name, release := range cfg.Aliases {
+		if name == "" || release == "" {
+			return fmt.Errorf("alias %q=%q: both name and release are required", name, release)
+		}
+	}
+
+	rules := make(map[string]bool)
+	for i := range cfg.AliasRules {
+		ar := &cfg.AliasRules[i]
+		if err := ar.validate(); err != nil {
+			return fmt.Errorf("alias rule %d: %s", i+1, err.Error())
+		}
+		if _, found := cfg.Aliases[ar.Name]; found || rules[ar.Name] {
+			return fmt.Errorf("alias rule %d: %q is already defined", i+1, ar.Name)
+		}
+		rules[ar.Name] = true
+	}
+
+	if cfg.Listen.HTTP == "" {
+		return fmt.Errorf("listen: an http address is required")
+	}
+	if cfg.FetchRoutines < 1 {
+		return fmt.Errorf("fetch_routines should be at least 1, got %d", cfg.FetchRoutines)
+	}
+	for i, s := range cfg.DiffSources {
+		if err := validateSource(s); err != nil {
+			return fmt.Errorf("diff source %d: %s", i+1, err.Error())
+		}
+	}
+	if cfg.MetadataCache.Packages < 0 {
+		return fmt.Errorf("metadata_cache: packages can not be negative")
+	}
+	if cfg.DiffCache.Entries < 1 {
+		return fmt.Errorf("diff_cache: entries should be at least 1, got %d", cfg.DiffCache.Entries)
+	}
+	if cfg.Metadata != metadataAuto && cfg.Metadata != metadataXML {
+		return fmt.Errorf("metadata should be either %s or %s, got %q", metadataAuto, metadataXML, cfg.Metadata)
+	}
+	if cfg.TTL.Mirror < 0 || cfg.TTL.Mirrorlist < 0 || cfg.TTL.Repodiff < 0 {
+		return fmt.Errorf("ttl: durations can not be negative")
+	}
+	if cfg.TTL.Rules < time.Minute {
+		return fmt.Errorf("ttl: rules should be at least 1m, got %s", cfg.TTL.Rules)
+	}
+	if cfg.Timeouts.Check <= 0 || cfg.Timeouts.Shutdown <= 0 || cfg.Timeouts.Idle <= 0 {
+		return fmt.Errorf("timeouts: durations should be larger than 0")
+	}
+	if cfg.Proxy != "" {
+		if _, err := url.Parse(cfg.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy %q (%s)", cfg.Proxy, err.Error())
+		}
+	}
+
+	for name, token := range cfg.Admin.Tokens {
+		if len(token) < 16 {
+			return fmt.Errorf("admin: token for %q should be at least 16 characters", name)
+		}
+	}
+	if len(cfg.Admin.Tokens) > 0 && (cfg.Admin.StateFile == "" || cfg.Admin.AuditLog == "") {
+		return fmt.Errorf("admin: both state_file and audit_log are required when tokens are set")
+	}
+
+	for i := range cfg.Jobs {
+		if err := cfg.Jobs[i].validate(); err != nil {
+			return fmt.Errorf("job %d: %s", i+1, err.Error())
+		}
+	}
+
+	feednames := make(map[string]bool)
+	for i := range cfg.Feeds {
+		if err := cfg.Feeds[i].validate(); err != nil {
+			return fmt.Errorf("feed %d: %s", i+1, err.Error())
+		}
+		if feednames[cfg.Feeds[i].Name] {
+			return fmt.Errorf("feed %d: duplicate name %q", i+1, cfg.Feeds[i].Name)
+		}
+		feednames[cfg.Feeds[i].Name] = true
+	}
+
+	webhooknames := make(map[string]bool)
+	for i := range cfg.Webhooks {
+		if err := cfg.Webhooks[i].validate(); err != nil {
+			return fmt.Errorf("webhook %d: %s", i+1, err.Error())
+		}
+		if webhooknames[cfg.Webhooks[i].Name] {
+			return fmt.Errorf("webhook %d: duplicate name %q", i+1, cfg.Webhooks[i].Name)
+		}
+		webhooknames[cfg.Webhooks[i].Name] = true
+	}
+
+	if cfg.GPG.Require && len(cfg.GPG.Keys) < 1 {
+		return fmt.Errorf("gpg: signatures can not be required without any keys")
+	}
+
+	return nil
+}
+
+// newClient builds an http client with its own transport, so mirrors with
+// different TLS or proxy settings do not get in each others way.
+func newClient(insecureSkipVerify bool, certs []tls.Certificate, proxy string) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: insecureSkipVerify,
+			Certificates:       certs,
+		},
+		DisableCompression: false,
+	}
+
+	if proxy != "" {
+		if proxyURL, err := url.Parse(proxy); err == nil {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	return &http.Client{Transport: tr}
+}
+
+// buildMirrors turns the mirror configuration into mirrorsites, ordered by
+// weight so the heaviest mirrors are listed first.
+func (cfg *config) buildMirrors(certs []tls.Certificate) (sites []*mirrorsite, err error) {
+	for _, mc := range cfg.Mirrors {
+		insecure := cfg.InsecureSkipVerify
+		if mc.TLS.InsecureSkipVerify != nil {
+			insecure = *mc.TLS.InsecureSkipVerify
+		}
+
+		mcerts := certs
+		if mc.TLS.ClientCert != "" {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(mc.TLS.ClientCert, mc.TLS.ClientKey); err != nil {
+				err = fmt.Errorf("mirror %q: unable to load client-TLS keypair (%s)", mc.Name, err.Error())
+				return
+			}
+			mcerts = []tls.Certificate{cert}
+		}
+
+		proxy := cfg.Proxy
+		if mc.Proxy != "" {
+			proxy = mc.Proxy
+		}
+
+		routines := cfg.FetchRoutines
+		if mc.FetchRoutines > 0 {
+			routines = mc.FetchRoutines
+		}
+
+		sites = append(sites, &mirrorsite{
+			name:     mc.Name,
+			url:      mc.URL,
+			weight:   mc.Weight,
+			routines: routines,
+			repos:    mc.Repos,
+			releases: mc.Releases,
+			state:    mc.State,
+			client:   newClient(insecure, mcerts, proxy),
+		})
+	}
+
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].weight > sites[j].weight
+	})
+	return
+}
+
+// liveconfig is everything requests need from the configuration. it gets
+// replaced as a whole on reload, so a request should fetch it once using
+// current() and stick with that for its whole lifetime.
+type liveconfig struct {
+	*config
+	client         *http.Client
+	mirrors        []*mirrorsite
+	aliases        map[string]string
+	keyring        openpgp.EntityList      // trusted keys, nil when signatures are not checked
+	webhookclients map[string]*http.Client // by name of the webhook
+}
+
+var live atomic.Value
+
+// current returns the configuration in use right now.
+func current() *liveconfig {
+	return live.Load().(*liveconfig)
+}
+
+// newLiveConfig builds the clients and mirrors from a validated config.
+func newLiveConfig(cfg *config) (lc *liveconfig, err error) {
+	if len(cfg.Mirrors) < 1 {
+		warn("no repository mirrors specified in REPO_MIRRORS environment variable or configuration file, replies will be status 204")
+	}
+
+	if len(cfg.Aliases) < 1 {
+		info("no release aliases specified in RELEASE_ALIASES environment variable or configuration file, doing pass-through release names")
+	}
+
+	if cfg.InsecureSkipVerify {
+		warn("certificate verification of mirrors with TLS support is disabled")
+	}
+
+	var certs []tls.Certificate
+	if cert, err := tls.LoadX509KeyPair("client-cert.pem", "client-key.pem"); err == nil {
+		info("Found client-TLS keypair, HTTP requests will be authenticated")
+		certs = []tls.Certificate{cert}
+	}
+
+	if cfg.Proxy != "" {
+		info("Found HTTP proxy declaration, HTTP requests be sent through proxy")
+	}
+
+	lc = &liveconfig{
+		config:  cfg,
+		client:  newClient(cfg.InsecureSkipVerify, certs, cfg.Proxy),
+		aliases: cfg.Aliases,
+	}
+
+	// webhooks are not mirrors, so they get clients of their own without the
+	// client-TLS keypair, proxy and certificate settings meant for mirrors
+	lc.webhookclients = make(map[string]*http.Client)
+	for _, wh := range cfg.Webhooks {
+		lc.webhookclients[wh.Name] = newClient(wh.TLS.InsecureSkipVerify, nil, wh.Proxy)
+	}
+
+	if lc.keyring, err = loadKeyring(cfg.GPG.Keys); err != nil {
+		return
+	} else if len(lc.keyring) > 0 {
+		info("Found gpg keys, signatures of repos and packages will be verified", "keys", len(lc.keyring))
+	}
+
+	lc.mirrors, err = cfg.buildMirrors(certs)
+	return
+}
+
+// resolve returns the release an alias (or alias rule) points to, or the
+// release itself if it is not an alias.
+func (lc *liveconfig) resolve(release string) string {
+	if alias, ok := lc.aliases[release]; ok {
+		return alias
+	}
+	if alias, ok := resolveRule(release); ok {
+		return alias
+	}
+	return release
+}
+
+// mirrorfor finds the configured mirror a uri belongs to, or nil if the uri
+// is not on any of the mirrors.
+func (lc *liveconfig) mirrorfor(uri string) (site *mirrorsite) {
+	for _, m := range lc.mirrors {
+		if uri == m.url || strings.HasPrefix(uri, m.url+"/") {
+			if site == nil || len(m.url) > len(site.url) {
+				site = m
+			}
+		}
+	}
+	return
+}
+
+// clientfor returns the http client to use for a uri, which is the client
+// of its mirror or the default client if the uri is not on any mirror. local
+// file:// uris get a client which reads from the filesystem.
+func (lc *liveconfig) clientfor(uri string) *http.Client {
+	if strings.HasPrefix(uri, "file://") {
+		return localclient
+	}
+	if m := lc.mirrorfor(uri); m != nil {
+		return m.client
+	}
+	return lc.client
+}
+
+// routinesfor returns how many parallel fetches are allowed for a uri.
+func (lc *liveconfig) routinesfor(uri string) int {
+	if m := lc.mirrorfor(uri); m != nil {
+		return m.routines
+	}
+	return lc.FetchRoutines
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consistencyresult is how a single mirror compares to the majority of the
+// mirrors for the same repo.
+type consistencyresult struct {
+	Mirror    string      `json:"mirror"`
+	URI       string      `json:"uri"`
+	State     string      `json:"state"`
+	Status    string      `json:"status"` // one of consistent, inconsistent, error or skipped
+	Revision  string      `json:"revision"`
+	Missing   []nevra     `json:"missing,omitempty"`
+	Extra     []nevra     `json:"extra,omitempty"`
+	Differing []pkgchange `json:"differing,omitempty"`
+	Error     string      `json:"error,omitempty"`
+
+	fingerprint string // checksum of the package metadata, if known
+}
+
+// fingerprint returns what identifies the packages of a repo, which is the
+// checksum of its primary data if repomd.xml lists one.
+func fingerprint(rmd *repomd) string {
+	for _, datatype := range []string{"primary", "primary_db"} {
+		if key, ok := pkgkeyfor(rmd, datatype); ok {
+			return key.datatype + ":" + key.checksum
+		}
+	}
+	return ""
+}
+
+// majority returns the value most mirrors agree on. ties go to the value
+// seen first, which is from the mirror with the highest weight.
+func majority(values []string) (winner string) {
+	counts := make(map[string]int)
+	for _, v := range values {
+		counts[v]++
+		if counts[v] > counts[winner] {
+			winner = v
+		}
+	}
+	return
+}
+
+// checkConsistency compares the repo on every mirror to the repo on the
+// mirrors most of them agree with.
+func checkConsistency(lc *liveconfig, results []consistencyresult) {
+	var revisions, fingerprints []string
+	for _, c := range results {
+		if c.Status == "" {
+			revisions = append(revisions, c.Revision)
+			fingerprints = append(fingerprints, c.fingerprint)
+		}
+	}
+	if len(revisions) < 1 {
+		return
+	}
+	revision, fp := majority(revisions), majority(fingerprints)
+
+	// the packages of every mirror are compared to the first mirror which has
+	// the majority of both
+	reference := -1
+	for i, c := range results {
+		if c.Status == "" && c.Revision == revision && c.fingerprint == fp {
+			reference = i
+			break
+		}
+	}
+
+	for i := range results {
+		c := &results[i]
+		if c.Status != "" {
+			continue
+		}
+		c.Status = "consistent"
+		if c.Revision != revision {
+			c.Status = "inconsistent"
+		}
+		if reference < 0 || i == reference || (len(fp) > 0 && c.fingerprint == fp) {
+			continue
+		}
+
+		// going from this mirror to the reference, what gets added is missing
+		// and what gets removed is extra
+		var err error
+		if c.Missing, c.Differing, c.Extra, err = mirrordiff(lc, c.URI, results[reference].URI); err != nil {
+			warn("unable to compare packages of mirror", "mirror", c.Mirror, "uri", c.URI, "err", err.Error())
+			c.Status, c.Error = "error", err.Error()
+			continue
+		}
+		if len(c.Missing)+len(c.Extra)+len(c.Differing) > 0 {
+			c.Status = "inconsistent"
+		}
+	}
+}
+
+func consistencyRequest(w http.ResponseWriter, r *http.Request) {
+	release := r.URL.Query().Get("release")
+	repo := r.URL.Query().Get("repo")
+	arch := r.URL.Query().Get("arch")
+	maintenance := r.URL.Query().Get("maintenance")
+	lc := current()
+
+	if len(release) < 1 || len(repo) < 1 {
+		warn("not enough parameters sent", "release", release, "repo", repo, "uri", r.RequestURI)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if len(lc.mirrors) < 1 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	release = lc.resolve(release)
+	t0 := time.Now()
+	results := make([]consistencyresult, 0)
+	for _, mirror := range lc.mirrors {
+		if !mirror.serves(release, repo) {
+			continue
+		}
+		result := consistencyresult{Mirror: mirror.name, URI: mirror.uri(release, repo, arch), State: mirror.state}
+		if !mirror.checked(maintenance) {
+			debug("skipping mirror in maintenance", "mirror", mirror.name, "state", mirror.state)
+			result.Status = "skipped"
+		} else if rmd, err := fetchRepomd(lc, result.URI); err != nil {
+			warn("unable to check consistency", "mirror", mirror.name, "release", release, "repo", repo, "err", err.Error())
+			result.Status, result.Error = "error", err.Error()
+		} else {
+			result.Revision, result.fingerprint = rmd.Revision, fingerprint(rmd)
+		}
+		results = append(results, result)
+	}
+
+	checkConsistency(lc, results)
+	debug("consistency", "status", "done", "release", release, "repo", repo, "mirrors", len(results), "elapsed", time.Since(t0))
+
+	switch outputFormat(r) {
+	case formatJSON:
+		writeJSON(w, http.StatusOK, results)
+	case formatCSV:
+		records := [][]string{{"mirror", "uri", "state", "status", "revision", "missing", "extra", "differing", "error"}}
+		for _, c := range results {
+			records = append(records, []string{
+				c.Mirror, c.URI, c.State, c.Status, c.Revision,
+				strconv.Itoa(len(c.Missing)), strconv.Itoa(len(c.Extra)), strconv.Itoa(len(c.Differing)), c.Error,
+			})
+		}
+		writeCSV(w, http.StatusOK, records)
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for _, c := range results {
+			switch c.Status {
+			case "skipped":
+				w.Write([]byte(c.URI + " SKIPPED (" + strings.ToUpper(c.State) + ")\n"))
+			case "error":
+				w.Write([]byte(c.URI + " NOT CHECKED\n"))
+			case "inconsistent":
+				w.Write([]byte(c.URI + " INCONSISTENT (revision " + c.Revision + ", " +
+					strconv.Itoa(len(c.Missing)) + " missing, " + strconv.Itoa(len(c.Extra)) + " extra, " +
+					strconv.Itoa(len(c.Differing)) + " differing)\n"))
+				for _, p := range c.Missing {
+					w.Write([]byte("- " + p.String() + "\n"))
+				}
+				for _, p := range c.Extra {
+					w.Write([]byte("+ " + p.String() + "\n"))
+				}
+				for _, d := range c.Differing {
+					w.Write([]byte("! " + d.String() + " (" + d.Type + ")\n"))
+				}
+			default:
+				w.Write([]byte(c.URI + " CONSISTENT (revision " + c.Revision + ")\n"))
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// pkgdep is a single requires, provides, obsoletes or conflicts entry of a
+// package in primary.xml.
+type pkgdep struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr"`
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+// pkgformat is the rpm specific part of a package in primary.xml. files only
+// holds the few paths primary.xml lists (like /usr/bin and /etc), which is
+// enough to resolve most requirements on files.
+type pkgformat struct {
+	Requires  []pkgdep `xml:"requires>entry"`
+	Provides  []pkgdep `xml:"provides>entry"`
+	Obsoletes []pkgdep `xml:"obsoletes>entry"`
+	Conflicts []pkgdep `xml:"conflicts>entry"`
+	Files     []string `xml:"file"`
+}
+
+var depflags = map[string]string{"EQ": "=", "LT": "<", "LE": "<=", "GT": ">", "GE": ">="}
+
+// String returns a dependency the way rpm shows it, like "glibc >= 2.17".
+func (d pkgdep) String() (s string) {
+	s = d.Name
+	if op, found := depflags[d.Flags]; found {
+		s += " " + op + " "
+		if d.Epoch != "" && d.Epoch != "0" {
+			s += d.Epoch + ":"
+		}
+		s += d.Ver
+		if len(d.Rel) > 0 {
+			s += "-" + d.Rel
+		}
+	}
+	return
+}
+
+// satisfies returns whether a provide matches a requirement. like rpm, a
+// provide without a version matches any version and the release is only
+// compared when the requirement has one.
+func (p pkgdep) satisfies(r pkgdep) bool {
+	if p.Name != r.Name {
+		return false
+	}
+	if _, found := depflags[r.Flags]; !found {
+		return true
+	}
+	if p.Flags != "EQ" {
+		// ranges on both sides are rare enough to give them the benefit of
+		// the doubt
+		return true
+	}
+
+	rel := p.Rel
+	if len(r.Rel) < 1 {
+		rel = ""
+	}
+	switch c := evrcmp(p.Epoch, p.Ver, rel, r.Epoch, r.Ver, r.Rel); r.Flags {
+	case "EQ":
+		return c == 0
+	case "LT":
+		return c < 0
+	case "LE":
+		return c <= 0
+	case "GT":
+		return c > 0
+	case "GE":
+		return c >= 0
+	}
+	return false
+}
+
+// depchange lists the entries of one kind of dependency which were added to
+// or removed from a package between two releases.
+type depchange struct {
+	Name    string   `json:"name"`
+	Arch    string   `json:"arch"`
+	Kind    string   `json:"kind"` // one of requires, provides, obsoletes or conflicts
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// unsatisfied is a requirement of a package in the new release which nothing
+// in the repo set provides.
+type unsatisfied struct {
+	Package  string `json:"package"`
+	Requires string `json:"requires"`
+}
+
+// pkgdeps is what is needed of a package to compare and resolve dependencies.
+type pkgdeps struct {
+	vers   pkgvers
+	format pkgformat
+}
+
+// fetchDeps returns the dependencies of the newest build of every package in
+// a repo.
+func fetchDeps(lc *liveconfig, uri string) (deps map[pkgshort]pkgdeps, err error) {
+	deps = make(map[pkgshort]pkgdeps)
+	err = eachPackageFormat(lc, uri, func(p *primarypkg) {
+		entry := pkgshort{name: p.Name, arch: p.Arch}
+		vers := p.vers()
+		if first, dup := deps[entry]; dup {
+			if c := vers.cmp(first.vers); c < 0 || (c == 0 && vers.time <= first.vers.time) {
+				return
+			}
+		}
+		deps[entry] = pkgdeps{vers: vers, format: p.Format}
+	})
+	return
+}
+
+// diffdeps returns the entries which are only in a and only in b.
+func diffdeps(a, b []pkgdep) (onlya, onlyb []string) {
+	seta := make(map[string]bool)
+	for _, d := range a {
+		seta[d.String()] = true
+	}
+	setb := make(map[string]bool)
+	for _, d := range b {
+		setb[d.String()] = true
+	}
+	for d := range seta {
+		if !setb[d] {
+			onlya = append(onlya, d)
+		}
+	}
+	for d := range setb {
+		if !seta[d] {
+			onlyb = append(onlyb, d)
+		}
+	}
+	sort.Strings(onlya)
+	sort.Strings(onlyb)
+	return
+}
+
+// selfless leaves out the provide every package has of its own name and
+// version, which changes with every new version and says nothing.
+func selfless(name string, provides []pkgdep) (deps []pkgdep) {
+	for _, d := range provides {
+		if d.Name != name || d.Flags != "EQ" {
+			deps = append(deps, d)
+		}
+	}
+	return
+}
+
+// resolvable returns whether a requirement can be checked against primary.xml
+// at all. rpmlib() requirements are provided by rpm itself, rich dependencies
+// are not parsed and only some files are listed in primary.xml.
+func resolvable(r pkgdep) bool {
+	switch {
+	case strings.HasPrefix(r.Name, "rpmlib("), strings.HasPrefix(r.Name, "("):
+		return false
+	case strings.HasPrefix(r.Name, "/"):
+		for _, dir := range []string{"/etc/", "/bin/", "/sbin/", "/usr/bin/", "/usr/sbin/"} {
+			if strings.HasPrefix(r.Name, dir) {
+				return true
+			}
+		}
+		return r.Name == "/usr/lib/sendmail"
+	}
+	return true
+}
+
+// addDeps fills in the dependency changes of every package in both releases
+// of a diff, and the requirements of the new release which can not be met by
+// the new repo and the extra repos given.
+func addDeps(lc *liveconfig, diff *repodiff, extra []string) (err error) {
+	var olddeps, newdeps map[pkgshort]pkgdeps
+	if olddeps, err = fetchDeps(lc, diff.olduri); err != nil {
+		return
+	}
+	if newdeps, err = fetchDeps(lc, diff.newuri); err != nil {
+		return
+	}
+
+	changes := make([]depchange, 0)
+	for p, n := range newdeps {
+		o, found := olddeps[p]
+		if !found {
+			continue
+		}
+		for _, kind := range []struct {
+			name     string
+			old, new []pkgdep
+		}{
+			{"requires", o.format.Requires, n.format.Requires},
+			{"provides", selfless(p.name, o.format.Provides), selfless(p.name, n.format.Provides)},
+			{"obsoletes", o.format.Obsoletes, n.format.Obsoletes},
+			{"conflicts", o.format.Conflicts, n.format.Conflicts},
+		} {
+			if removed, added := diffdeps(kind.old, kind.new); len(added)+len(removed) > 0 {
+				changes = append(changes, depchange{Name: p.name, Arch: p.arch, Kind: kind.name, Added: added, Removed: removed})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		if changes[i].Arch != changes[j].Arch {
+			return changes[i].Arch < changes[j].Arch
+		}
+		return changes[i].Kind < changes[j].Kind
+	})
+
+	// everything the repo set provides, by name
+	provides := make(map[string][]pkgdep)
+	files := make(map[string]bool)
+	addprovides := func(deps map[pkgshort]pkgdeps) {
+		for _, d := range deps {
+			for _, p := range d.format.Provides {
+				provides[p.Name] = append(provides[p.Name], p)
+			}
+			for _, f := range d.format.Files {
+				files[f] = true
+			}
+		}
+	}
+	addprovides(newdeps)
+	for _, uri := range extra {
+		var deps map[pkgshort]pkgdeps
+		if deps, err = fetchDeps(lc, uri); err != nil {
+			return
+		}
+		addprovides(deps)
+	}
+
+	missing := make([]unsatisfied, 0)
+	for p, d := range newdeps {
+		for _, r := range d.format.Requires {
+			if !resolvable(r) || files[r.Name] {
+				continue
+			}
+			var ok bool
+			for _, prov := range provides[r.Name] {
+				if prov.satisfies(r) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				missing = append(missing, unsatisfied{Package: p.nevra(d.vers).String(), Requires: r.String()})
+			}
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].Package != missing[j].Package {
+			return missing[i].Package < missing[j].Package
+		}
+		return missing[i].Requires < missing[j].Requires
+	})
+
+	diff.depchanges = changes
+	diff.unsatisfied = missing
+	diff.deps = true
+	diff.depsagainst = strings.Join(extra, " ")
+	return
+}
+
+// formatDeps returns the dependency changes and unsatisfied requirements of a
+// diff as lines of a repodiff.
+func formatDeps(changes []depchange, missing []unsatisfied) (s string) {
+	for _, c := range changes {
+		for _, d := range c.Added {
+			s += "~ " + c.Name + "." + c.Arch + " " + c.Kind + " + " + d + "\n"
+		}
+		for _, d := range c.Removed {
+			s += "~ " + c.Name + "." + c.Arch + " " + c.Kind + " - " + d + "\n"
+		}
+	}
+	for _, m := range missing {
+		s += "? " + m.Package + " requires " + m.Requires + " (UNSATISFIED)\n"
+	}
+	return
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	diffcache = newDiffStore()
+)
+
+// diffkey identifies a repodiff. it includes the repomd revisions of both
+// sides, so a diff is computed again as soon as either release changes
+// upstream.
+type diffkey struct {
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	Repo        string `json:"repo"`
+	Arch        string `json:"arch"`
+	OldRevision string `json:"old_revision"`
+	NewRevision string `json:"new_revision"`
+}
+
+// diffstore is a cache of repodiffs which holds on to a limited number of
+// them, evicting the least recently used first. diffs older than the
+// repodiff ttl are not used anymore.
+type diffstore struct {
+	sync.Mutex
+	entries map[diffkey]*list.Element
+	order   *list.List // most recently used in front
+}
+
+type diffentry struct {
+	key  diffkey
+	diff repodiff
+}
+
+func newDiffStore() *diffstore {
+	return &diffstore{entries: make(map[diffkey]*list.Element), order: list.New()}
+}
+
+// expired returns whether a diff is too old to be used.
+func expired(d repodiff) bool {
+	ttl := current().TTL.Repodiff
+	return ttl > 0 && time.Since(d.lastcheck) > ttl
+}
+
+// get returns a cached diff, if it is there and not expired.
+func (s *diffstore) get(key diffkey) (diff repodiff, found bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	var e *list.Element
+	if e, found = s.entries[key]; !found {
+		return
+	}
+	if diff = e.Value.(*diffentry).diff; expired(diff) {
+		s.order.Remove(e)
+		delete(s.entries, key)
+		return repodiff{}, false
+	}
+	s.order.MoveToFront(e)
+	return
+}
+
+// put adds or replaces a diff. diffs between the same releases with other
+// revisions are outdated by it and dropped, and the least recently used diffs
+// are evicted while there are more than allowed.
+func (s *diffstore) put(key diffkey, diff repodiff) {
+	s.Lock()
+	defer s.Unlock()
+
+	for k, e := range s.entries {
+		if k != key && k.Old == key.Old && k.New == key.New && k.Repo == key.Repo && k.Arch == key.Arch {
+			s.order.Remove(e)
+			delete(s.entries, k)
+		}
+	}
+
+	if e, found := s.entries[key]; found {
+		e.Value.(*diffentry).diff = diff
+		s.order.MoveToFront(e)
+	} else {
+		s.entries[key] = s.order.PushFront(&diffentry{key: key, diff: diff})
+	}
+
+	for max := current().DiffCache.Entries; s.order.Len() > max; {
+		e := s.order.Back()
+		debug("evicting repodiff", "old", e.Value.(*diffentry).key.Old, "new", e.Value.(*diffentry).key.New)
+		s.order.Remove(e)
+		delete(s.entries, e.Value.(*diffentry).key)
+	}
+}
+
+// drop removes every diff for which stale returns true.
+func (s *diffstore) drop(stale func(diff repodiff) bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for k, e := range s.entries {
+		if stale(e.Value.(*diffentry).diff) {
+			s.order.Remove(e)
+			delete(s.entries, k)
+		}
+	}
+}
+
+// diffrecord is a repodiff as it is written to disk.
+type diffrecord struct {
+	Key           diffkey       `json:"key"`
+	LastCheck     time.Time     `json:"lastcheck"`
+	OldURI        string        `json:"old_uri"`
+	NewURI        string        `json:"new_uri"`
+	OldRevision   string        `json:"old_revision"`
+	NewRevision   string        `json:"new_revision"`
+	Added         []nevra       `json:"added"`
+	Changed       []pkgchange   `json:"changed"`
+	Removed       []nevra       `json:"removed"`
+	Changelogs    bool          `json:"changelogs"`
+	Advisories    []advisory    `json:"advisories,omitempty"`
+	HasAdvisories bool          `json:"has_advisories"`
+	DepChanges    []depchange   `json:"dep_changes,omitempty"`
+	Unsatisfied   []unsatisfied `json:"unsatisfied,omitempty"`
+	Deps          bool          `json:"deps"`
+	DepsAgainst   string        `json:"deps_against,omitempty"`
+	FileChanges   []filechange  `json:"file_changes,omitempty"`
+	Files         bool          `json:"files"`
+	FilesPrefix   string        `json:"files_prefix,omitempty"`
+}
+
+// save writes all diffs which have not expired to a file, least recently used
+// first so loading them keeps the order.
+func (s *diffstore) save(filename string) (err error) {
+	s.Lock()
+	records := make([]diffrecord, 0, s.order.Len())
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		k, d := e.Value.(*diffentry).key, e.Value.(*diffentry).diff
+		if expired(d) {
+			continue
+		}
+		records = append(records, diffrecord{
+			Key: k, LastCheck: d.lastcheck,
+			OldURI: d.olduri, NewURI: d.newuri, OldRevision: d.oldrevision, NewRevision: d.newrevision,
+			Added: d.added, Changed: d.changed, Removed: d.removed, Changelogs: d.changelogs,
+			Advisories: d.advisories, HasAdvisories: d.hasadvisories,
+			DepChanges: d.depchanges, Unsatisfied: d.unsatisfied, Deps: d.deps, DepsAgainst: d.depsagainst,
+			FileChanges: d.filechanges, Files: d.files, FilesPrefix: d.filesprefix,
+		})
+	}
+	s.Unlock()
+
+	var b []byte
+	if b, err = json.Marshal(records); err != nil {
+		return fmt.Errorf("unable to encode repodiff cache (%s)", err.Error())
+	}
+
+	// write to a temporary file first, so a crash halfway does not leave a
+	// broken cache behind
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("unable to write repodiff cache (%s)", err.Error())
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("unable to write repodiff cache (%s)", err.Error())
+	}
+	return
+}
+
+// load reads diffs saved earlier, leaving out those which have expired since,
+// came from mirrors or sources which are not configured anymore or are of
+// unknown revisions. a missing file is not an error, there just is nothing to
+// load.
+func (s *diffstore) load(filename string) (n int, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to read repodiff cache (%s)", err.Error())
+	}
+
+	var records []diffrecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return 0, fmt.Errorf("unable to read repodiff cache (%s)", err.Error())
+	}
+
+	lc := current()
+	for _, r := range records {
+		d := repodiff{
+			lastcheck: r.LastCheck,
+			olduri:    r.OldURI, newuri: r.NewURI, oldrevision: r.OldRevision, newrevision: r.NewRevision,
+			added: r.Added, changed: r.Changed, removed: r.Removed, changelogs: r.Changelogs,
+			advisories: r.Advisories, hasadvisories: r.HasAdvisories,
+			depchanges: r.DepChanges, unsatisfied: r.Unsatisfied, deps: r.Deps, depsagainst: r.DepsAgainst,
+			filechanges: r.FileChanges, files: r.Files, filesprefix: r.FilesPrefix,
+		}
+		if expired(d) || !lc.diffable(d.olduri) || !lc.diffable(d.newuri) || !knownRevisions(r.Key.OldRevision) || !knownRevisions(r.Key.NewRevision) {
+			continue
+		}
+		s.put(r.Key, d)
+		n++
+	}
+	return
+}
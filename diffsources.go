@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// localclient reads repos from local directories through file:// uris
+	localclient = newLocalClient()
+)
+
+func newLocalClient() *http.Client {
+	t := &http.Transport{}
+	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Transport: t}
+}
+
+// sourceURI returns the uri of a repo to diff. a uri starting with pub/ is
+// short for the same path below the local pub directory.
+func sourceURI(s string) string {
+	s = strings.TrimRight(strings.TrimSpace(s), "/")
+	if s == "pub" || strings.HasPrefix(s, "pub/") {
+		if abs, err := filepath.Abs("pub"); err == nil {
+			s = "file://" + filepath.ToSlash(abs) + strings.TrimPrefix(s, "pub")
+		}
+	}
+	return s
+}
+
+// validateSource checks an entry of diff_sources.
+func validateSource(s string) error {
+	u, err := url.Parse(sourceURI(s))
+	if err != nil {
+		return fmt.Errorf("invalid url %q (%s)", s, err.Error())
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("url %q has no host", s)
+		}
+	case "file":
+	default:
+		return fmt.Errorf("url %q should start with http://, https://, file:// or pub/", s)
+	}
+	return nil
+}
+
+// allowedSource returns whether a uri may be diffed, which it may when it is
+// on or below one of the diff_sources. uris which try to climb out of a
+// directory with .. are never allowed.
+func (lc *liveconfig) allowedSource(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.User != nil || len(u.RawQuery) > 0 || len(u.Fragment) > 0 || len(u.Path) < 1 {
+		return false
+	}
+	if path.Clean(u.Path) != u.Path {
+		return false
+	}
+
+	for _, s := range lc.DiffSources {
+		a, err := url.Parse(sourceURI(s))
+		if err != nil || a.Scheme != u.Scheme || a.Host != u.Host {
+			continue
+		}
+		prefix := strings.TrimRight(a.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffable returns whether a cached repodiff of a uri may still be used,
+// which is as long as it is on a mirror or an allowed source.
+func (lc *liveconfig) diffable(uri string) bool {
+	return lc.mirrorfor(uri) != nil || lc.allowedSource(uri)
+}
+
+// diffSources returns the repos one side of a repodiff can be made from,
+// either given directly by uri or found on the mirrors by release. forbidden
+// is true when the uri is not an allowed source.
+func diffSources(lc *liveconfig, release, uri, repo, arch string) (uris []string, forbidden bool) {
+	uris = make([]string, 0)
+	if len(uri) > 0 {
+		if uri = sourceURI(uri); !lc.allowedSource(uri) {
+			return uris, true
+		}
+		if checkMirror(lc, uri) {
+			uris = append(uris, uri)
+		} else {
+			warn("source does not have a valid repo", "uri", uri)
+		}
+		return
+	}
+
+	for _, mirror := range lc.mirrors {
+		if !mirror.checked("") || !mirror.serves(release, repo) {
+			continue
+		}
+		u := mirror.uri(release, repo, arch)
+		if checkMirror(lc, u) {
+			uris = append(uris, u)
+		} else {
+			warn("mirror does not have requested repo", "mirror", mirror.name, "release", release, "repo", repo)
+		}
+	}
+	return
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// feeds holds the state of every feed by name, across reloads
+	feeds = &sync.Map{}
+
+	// only one feed is written to the feed file at a time
+	feedfilelock sync.Mutex
+)
+
+// feedconfig defines a release, repo and arch of which the package set is
+// snapshotted every interval. the changes between consecutive snapshots are
+// published as an atom feed.
+type feedconfig struct {
+	Name     string        `yaml:"name"`
+	Release  string        `yaml:"release"`
+	Repo     string        `yaml:"repo"`
+	Arch     string        `yaml:"arch"`
+	Interval time.Duration `yaml:"interval"`
+	Entries  int           `yaml:"entries"` // how many entries the feed keeps at most
+}
+
+func (f *feedconfig) validate() error {
+	if len(f.Name) < 1 || strings.ContainsAny(f.Name, "/?#& ") {
+		return fmt.Errorf("name is required and can not contain any of /?#& or spaces, got %q", f.Name)
+	}
+	if len(f.Release) < 1 || len(f.Repo) < 1 {
+		return fmt.Errorf("both release and repo are required")
+	}
+	if f.Interval < time.Minute {
+		return fmt.Errorf("interval should be at least 1m, got %s", f.Interval)
+	}
+	if f.Entries == 0 {
+		f.Entries = 100
+	} else if f.Entries < 0 {
+		return fmt.Errorf("entries can not be negative")
+	}
+	return nil
+}
+
+// feedentry is a single package which changed between two snapshots.
+type feedentry struct {
+	ID      string    `json:"id"`
+	Change  string    `json:"change"` // added, removed or the type of change
+	Package nevra     `json:"package"`
+	Old     *nevra    `json:"old,omitempty"`
+	Link    string    `json:"link"`
+	Updated time.Time `json:"updated"`
+}
+
+// title returns what a feed reader shows for the entry.
+func (e feedentry) title() string {
+	return e.Package.String() + " (" + e.Change + ")"
+}
+
+// summary describes the change of the entry in a line.
+func (e feedentry) summary() string {
+	switch {
+	case e.Old != nil:
+		return e.Old.String() + " -> " + e.Package.String()
+	case e.Change == "removed":
+		return e.Package.String() + " was removed"
+	}
+	return e.Package.String() + " was added"
+}
+
+// feedstate is the last snapshot of a feed along with the entries it has
+// published so far, newest first.
+type feedstate struct {
+	sync.Mutex
+	repo      string // repo and arch the snapshot is of
+	release   string
+	uri       string
+	revision  string
+	lastcheck time.Time
+	snapshot  map[pkgshort]pkgvers
+	entries   []feedentry
+}
+
+func feedstatefor(name string) *feedstate {
+	v, _ := feeds.LoadOrStore(name, &feedstate{})
+	return v.(*feedstate)
+}
+
+// feedfor returns the configuration of a feed by name.
+func (lc *liveconfig) feedfor(name string) *feedconfig {
+	for i := range lc.Feeds {
+		if lc.Feeds[i].Name == name {
+			return &lc.Feeds[i]
+		}
+	}
+	return nil
+}
+
+// startFeeds takes the first snapshot of every feed right away, and keeps
+// taking them until the returned channel gets closed.
+func startFeeds(list []feedconfig) (stop chan struct{}) {
+	stop = make(chan struct{})
+	for _, f := range list {
+		info("scheduling feed", "feed", f.Name, "interval", f.Interval)
+		go func(f feedconfig) {
+			ticker := time.NewTicker(f.Interval)
+			defer ticker.Stop()
+			for {
+				updateFeed(f)
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(f)
+	}
+	return
+}
+
+// updateFeed takes a snapshot of the package set of a feed and adds entries
+// for whatever changed since the previous one. nothing is fetched when the
+// release still has the same revision.
+func updateFeed(f feedconfig) {
+	lc := current()
+	release := lc.resolve(f.Release)
+	st := feedstatefor(f.Name)
+
+	uris, _ := diffSources(lc, release, "", f.Repo, f.Arch)
+	if len(uris) < 1 {
+		warn("no mirror has the repo of feed", "feed", f.Name, "release", release, "repo", f.Repo)
+		return
+	}
+	repo := f.Repo + "/" + f.Arch
+
+	// a snapshot of another repo or arch is of no use, which happens when
+	// the configuration of a feed changes
+	st.Lock()
+	if st.repo != repo {
+		st.snapshot = nil
+	}
+	previous := st.snapshot
+	pinned, since := st.uri, st.revision
+	if previous == nil || st.release != release {
+		pinned, since = "", ""
+	}
+	st.Unlock()
+
+	uri, found := feedSource(lc, uris, pinned, since)
+	if !found {
+		warn("no mirror has caught up with the snapshot of feed", "feed", f.Name, "release", release, "revision", since)
+		return
+	}
+	revision := mirrorStatus(lc, uri).revision
+
+	st.Lock()
+	unchanged := st.snapshot != nil && st.release == release && st.uri == uri && st.revision == revision
+	st.Unlock()
+	if unchanged {
+		st.Lock()
+		st.lastcheck = time.Now()
+		st.Unlock()
+		return
+	}
+
+	t0 := time.Now()
+	snapshot, err := fetchPackageSet(lc, []reposource{{uri: uri}})
+	if err != nil {
+		warn("unable to snapshot packages of feed", "feed", f.Name, "uri", uri, "err", err.Error())
+		return
+	} else if len(snapshot) < 1 {
+		// an empty repo is more likely a failed fetch than every package
+		// being removed, so keep the previous snapshot
+		warn("unable to snapshot packages of feed", "feed", f.Name, "uri", uri)
+		return
+	}
+
+	var entries []feedentry
+	if previous != nil {
+		added, changed, removed := diffPackageSets(previous, snapshot)
+		link := func(p nevra) string {
+			if v, found := snapshot[pkgshort{name: p.Name, arch: p.Arch}]; found && len(v.href) > 0 {
+				return uri + "/" + v.href
+			}
+			return uri
+		}
+		id := func(change string, p nevra) string {
+			return "urn:repogirl:" + f.Name + ":" + revision + ":" + change + ":" + p.String()
+		}
+		for _, p := range added {
+			entries = append(entries, feedentry{ID: id("added", p), Change: "added", Package: p, Link: link(p), Updated: t0})
+		}
+		for _, c := range changed {
+			old := c.Old
+			entries = append(entries, feedentry{ID: id(c.Type, c.New), Change: c.Type, Package: c.New, Old: &old, Link: link(c.New), Updated: t0})
+		}
+		for _, p := range removed {
+			entries = append(entries, feedentry{ID: id("removed", p), Change: "removed", Package: p, Link: uri, Updated: t0})
+		}
+	}
+
+	st.Lock()
+	st.repo, st.release, st.uri, st.revision, st.lastcheck, st.snapshot = repo, release, uri, revision, time.Now(), snapshot
+	if st.entries = append(entries, st.entries...); len(st.entries) > f.Entries {
+		st.entries = st.entries[:f.Entries]
+	}
+	st.Unlock()
+
+	info("feed updated", "feed", f.Name, "release", release, "revision", revision, "entries", len(entries), "elapsed", time.Since(t0))
+	if filename := lc.FeedFile; len(filename) > 0 {
+		if err := saveFeeds(filename); err != nil {
+			warn("unable to save feeds", "error", err.Error())
+		}
+	}
+}
+
+// feedSource picks the mirror to take the snapshot of a feed from. mirrors
+// do not all sync at the same time, so switching between them would make
+// packages seem to disappear and come back. the mirror of the previous
+// snapshot is used for as long as it has the repo, otherwise the first mirror
+// which is known not to be behind the previous revision. found is false if no
+// mirror can be compared to the previous snapshot.
+func feedSource(lc *liveconfig, uris []string, previous, revision string) (uri string, found bool) {
+	if len(previous) < 1 {
+		return uris[0], true
+	}
+	caughtup := func(u string) bool {
+		cmp, ok := compareRevisions(mirrorStatus(lc, u).revision, revision)
+		return ok && cmp >= 0
+	}
+	for _, u := range uris {
+		if u == previous && caughtup(u) {
+			return u, true
+		}
+	}
+	for _, u := range uris {
+		if caughtup(u) {
+			return u, true
+		}
+	}
+	return
+}
+
+// feedpkg is a package of a snapshot as it is written to disk.
+type feedpkg struct {
+	Name     string `json:"name"`
+	Arch     string `json:"arch"`
+	Epoch    string `json:"epoch"`
+	Version  string `json:"version"`
+	Release  string `json:"release"`
+	Time     int    `json:"time"`
+	Checksum string `json:"checksum,omitempty"`
+	Href     string `json:"href,omitempty"`
+}
+
+// feedrecord is the state of a feed as it is written to disk.
+type feedrecord struct {
+	Name      string      `json:"name"`
+	Repo      string      `json:"repo"`
+	Release   string      `json:"release"`
+	URI       string      `json:"uri"`
+	Revision  string      `json:"revision"`
+	LastCheck time.Time   `json:"lastcheck"`
+	Packages  []feedpkg   `json:"packages"`
+	Entries   []feedentry `json:"entries"`
+}
+
+// saveFeeds writes the snapshots and entries of all feeds to a file, so
+// neither gets lost on a restart.
+func saveFeeds(filename string) (err error) {
+	feedfilelock.Lock()
+	defer feedfilelock.Unlock()
+
+	records := make([]feedrecord, 0)
+	feeds.Range(func(k, v interface{}) bool {
+		st := v.(*feedstate)
+		st.Lock()
+		defer st.Unlock()
+		if st.snapshot == nil {
+			return true
+		}
+
+		rec := feedrecord{Name: k.(string), Repo: st.repo, Release: st.release, URI: st.uri, Revision: st.revision, LastCheck: st.lastcheck, Entries: st.entries}
+		for p, v := range st.snapshot {
+			rec.Packages = append(rec.Packages, feedpkg{Name: p.name, Arch: p.arch, Epoch: v.epoch, Version: v.ver, Release: v.rel, Time: v.time, Checksum: v.checksum, Href: v.href})
+		}
+		records = append(records, rec)
+		return true
+	})
+
+	var b []byte
+	if b, err = json.Marshal(records); err != nil {
+		return fmt.Errorf("unable to encode feeds (%s)", err.Error())
+	}
+
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("unable to write feeds (%s)", err.Error())
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("unable to write feeds (%s)", err.Error())
+	}
+	return
+}
+
+// loadFeeds reads the feeds saved earlier. a missing file is not an error,
+// every feed then starts out with an empty snapshot.
+func loadFeeds(filename string) (n int, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to read feeds (%s)", err.Error())
+	}
+
+	var records []feedrecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return 0, fmt.Errorf("unable to read feeds (%s)", err.Error())
+	}
+
+	for _, rec := range records {
+		st := feedstatefor(rec.Name)
+		st.Lock()
+		st.repo, st.release, st.uri, st.revision, st.lastcheck, st.entries = rec.Repo, rec.Release, rec.URI, rec.Revision, rec.LastCheck, rec.Entries
+		st.snapshot = make(map[pkgshort]pkgvers)
+		for _, p := range rec.Packages {
+			st.snapshot[pkgshort{name: p.Name, arch: p.Arch}] = pkgvers{epoch: p.Epoch, ver: p.Version, rel: p.Release, time: p.Time, checksum: p.Checksum, href: p.Href}
+		}
+		st.Unlock()
+		n++
+	}
+	return
+}
+
+type atomlink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomcategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomentry struct {
+	ID       string         `xml:"id"`
+	Title    string         `xml:"title"`
+	Updated  string         `xml:"updated"`
+	Links    []atomlink     `xml:"link"`
+	Category []atomcategory `xml:"category"`
+	Summary  string         `xml:"summary"`
+}
+
+type atomfeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle,omitempty"`
+	Updated   string      `xml:"updated"`
+	Author    string      `xml:"author>name"`
+	Generator string      `xml:"generator"`
+	Links     []atomlink  `xml:"link"`
+	Entries   []atomentry `xml:"entry"`
+}
+
+// selfURL returns the url a request was made to, as the client sees it.
+func selfURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+func feedRequest(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	lc := current()
+
+	// without a name, list which feeds there are
+	if len(name) < 1 {
+		type feedinfo struct {
+			Name      string    `json:"name"`
+			Release   string    `json:"release"`
+			Repo      string    `json:"repo"`
+			Arch      string    `json:"arch"`
+			Entries   int       `json:"entries"`
+			LastCheck time.Time `json:"lastcheck"`
+		}
+		list := make([]feedinfo, 0)
+		for _, f := range lc.Feeds {
+			st := feedstatefor(f.Name)
+			st.Lock()
+			list = append(list, feedinfo{Name: f.Name, Release: f.Release, Repo: f.Repo, Arch: f.Arch, Entries: len(st.entries), LastCheck: st.lastcheck})
+			st.Unlock()
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		if outputFormat(r) == formatJSON {
+			writeJSON(w, http.StatusOK, list)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for _, f := range list {
+			w.Write([]byte(fmt.Sprintf("%s %s/%s/%s (%d entries)\n", f.Name, f.Release, f.Repo, f.Arch, f.Entries)))
+		}
+		return
+	}
+
+	f := lc.feedfor(name)
+	if f == nil {
+		warn("unknown feed requested", "client", r.RemoteAddr, "feed", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// changes can be limited to some kinds, like only added packages
+	kinds := make(map[string]bool)
+	if len(r.URL.Query().Get("changes")) > 0 {
+		for _, k := range splitList(r.URL.Query().Get("changes")) {
+			kinds[strings.ToLower(k)] = true
+		}
+	}
+
+	st := feedstatefor(name)
+	st.Lock()
+	feed := atomfeed{
+		ID:        "urn:repogirl:" + name,
+		Title:     "repogirl: " + f.Release + "/" + f.Repo,
+		Subtitle:  "package changes in " + f.Release + "/" + f.Repo,
+		Updated:   st.lastcheck.UTC().Format(time.RFC3339),
+		Author:    "repogirl",
+		Generator: "repogirl " + version,
+		Links:     []atomlink{{Rel: "self", Type: "application/atom+xml", Href: selfURL(r)}},
+	}
+	if len(f.Arch) > 0 {
+		feed.Title += "/" + f.Arch
+		feed.Subtitle += "/" + f.Arch
+	}
+	if len(st.uri) > 0 {
+		feed.Links = append(feed.Links, atomlink{Rel: "related", Href: st.uri})
+	}
+	for _, e := range st.entries {
+		if len(kinds) > 0 && !kinds[e.Change] {
+			continue
+		}
+		feed.Entries = append(feed.Entries, atomentry{
+			ID:       e.ID,
+			Title:    e.title(),
+			Updated:  e.Updated.UTC().Format(time.RFC3339),
+			Links:    []atomlink{{Rel: "alternate", Href: e.Link}},
+			Category: []atomcategory{{Term: e.Change}},
+			Summary:  e.summary(),
+		})
+	}
+	st.Unlock()
+
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		warn("unable to encode feed", "feed", name, "err", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml")
+	w.Header().Set("Cache-Control", "max-age="+fmt.Sprint(int(f.Interval.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxfiles is how many files under a prefix are compared at most, so the
+// files of a repo do not all end up in memory and in the diff cache.
+const maxfiles = 10000
+
+// errTooManyFiles is returned when a prefix has more files than maxfiles.
+var errTooManyFiles = fmt.Errorf("more than %d files, use a longer prefix", maxfiles)
+
+// filelistpkg is a single package in filelists.xml.
+type filelistpkg struct {
+	Name    string `xml:"name,attr"`
+	Arch    string `xml:"arch,attr"`
+	Version struct {
+		Epoch string `xml:"epoch,attr"`
+		Ver   string `xml:"ver,attr"`
+		Rel   string `xml:"rel,attr"`
+	} `xml:"version"`
+	Files []struct {
+		Type string `xml:"type,attr"`
+		Path string `xml:",chardata"`
+	} `xml:"file"`
+}
+
+// filechange is a file which was added, removed or moved to another package
+// between two releases.
+type filechange struct {
+	Path   string   `json:"path"`
+	Change string   `json:"change"` // one of added, removed or moved
+	Old    []string `json:"old,omitempty"`
+	New    []string `json:"new,omitempty"`
+}
+
+// fetchFileOwners reads filelists.xml of a repo one package at a time and
+// returns which packages (as name.arch) own the files starting with prefix.
+// like the packages in a repodiff, only the newest build of a package counts.
+// directories are left out, they are usually owned by many packages at once.
+func fetchFileOwners(lc *liveconfig, uri, prefix string) (owners map[string][]string, err error) {
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
+		return
+	}
+
+	var rc io.ReadCloser
+	if rc, err = openData(lc, uri, rmd, "filelists"); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	// the files of the newest build of every package, by name.arch
+	type build struct {
+		vers  pkgvers
+		files []string
+	}
+	builds := make(map[string]build)
+	var count int
+
+	dec := xml.NewDecoder(rc)
+	for {
+		var tok xml.Token
+		if tok, err = dec.Token(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = fmt.Errorf("unable to read filelists.xml (%s)", err.Error())
+			return
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "package" {
+			continue
+		}
+
+		var p filelistpkg
+		if err = dec.DecodeElement(&p, &se); err != nil {
+			err = fmt.Errorf("unable to read filelists.xml (%s)", err.Error())
+			return
+		}
+		id := p.Name + "." + p.Arch
+		vers := pkgvers{epoch: p.Version.Epoch, ver: p.Version.Ver, rel: p.Version.Rel}
+		if b, found := builds[id]; found {
+			if vers.cmp(b.vers) <= 0 {
+				continue
+			}
+			count -= len(b.files)
+		}
+
+		var files []string
+		for _, f := range p.Files {
+			if f.Type != "dir" && strings.HasPrefix(f.Path, prefix) {
+				files = append(files, f.Path)
+			}
+		}
+		if count += len(files); count > maxfiles {
+			return nil, errTooManyFiles
+		}
+		builds[id] = build{vers: vers, files: files}
+	}
+
+	owners = make(map[string][]string)
+	for id, b := range builds {
+		for _, path := range b.files {
+			owners[path] = append(owners[path], id)
+		}
+	}
+	for _, pkgs := range owners {
+		sort.Strings(pkgs)
+	}
+	return
+}
+
+// addFiles fills in the files of a diff which were added, removed or changed
+// owner, limited to the paths starting with prefix.
+func addFiles(lc *liveconfig, diff *repodiff, prefix string) (err error) {
+	var oldowners, newowners map[string][]string
+	if oldowners, err = fetchFileOwners(lc, diff.olduri, prefix); err != nil {
+		return
+	}
+	if newowners, err = fetchFileOwners(lc, diff.newuri, prefix); err != nil {
+		return
+	}
+
+	changes := make([]filechange, 0)
+	for path, newpkgs := range newowners {
+		oldpkgs, found := oldowners[path]
+		if !found {
+			changes = append(changes, filechange{Path: path, Change: "added", New: newpkgs})
+		} else if strings.Join(oldpkgs, " ") != strings.Join(newpkgs, " ") {
+			changes = append(changes, filechange{Path: path, Change: "moved", Old: oldpkgs, New: newpkgs})
+		}
+	}
+	for path, oldpkgs := range oldowners {
+		if _, found := newowners[path]; !found {
+			changes = append(changes, filechange{Path: path, Change: "removed", Old: oldpkgs})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	diff.filechanges = changes
+	diff.files = true
+	diff.filesprefix = prefix
+	return
+}
+
+// formatFiles returns the changed files of a diff as lines of a repodiff.
+func formatFiles(changes []filechange) (s string) {
+	for _, c := range changes {
+		switch c.Change {
+		case "added":
+			s += "+ " + c.Path + " (" + strings.Join(c.New, ", ") + ")\n"
+		case "removed":
+			s += "- " + c.Path + " (" + strings.Join(c.Old, ", ") + ")\n"
+		default:
+			s += "> " + c.Path + " (" + strings.Join(c.Old, ", ") + " -> " + strings.Join(c.New, ", ") + ")\n"
+		}
+	}
+	return
+}
@@ -11,6 +11,10 @@ func enable_debugging() {
 	logrus.SetLevel(logrus.DebugLevel)
 }
 
+func disable_debugging() {
+	logrus.SetLevel(logrus.InfoLevel)
+}
+
 func makefields(ctx ...interface{}) (fields logrus.Fields) {
 	fields = make(logrus.Fields)
 	for i := 0; i < len(ctx); i += 2 {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// jobconfig defines a repohealth or repomirror run which is repeated every
+// interval, instead of having to be requested over http.
+type jobconfig struct {
+	Name     string        `yaml:"name"`
+	Type     string        `yaml:"type"` // either "health" or "mirror"
+	Release  string        `yaml:"release"`
+	Repo     string        `yaml:"repo"`
+	Arch     string        `yaml:"arch"`
+	Interval time.Duration `yaml:"interval"`
+
+	// either "include" or "skip" mirrors in maintenance, see mirrorsite.checked
+	Maintenance string `yaml:"maintenance"`
+
+	// how thoroughly a health job checks packages, see parseHealthCheck
+	Mode   string `yaml:"mode"`
+	Sample int    `yaml:"sample"`
+}
+
+func (j *jobconfig) validate() error {
+	if j.Type != "health" && j.Type != "mirror" {
+		return fmt.Errorf("type should be either health or mirror, got %q", j.Type)
+	}
+	if len(j.Release) < 1 || len(j.Repo) < 1 {
+		return fmt.Errorf("both release and repo are required")
+	}
+	if j.Maintenance != "" && j.Maintenance != "include" && j.Maintenance != "skip" {
+		return fmt.Errorf("maintenance should be either include or skip, got %q", j.Maintenance)
+	}
+	if _, err := parseHealthCheck(j.Mode, j.Sample); err != nil {
+		return err
+	} else if j.Type != "health" && (len(j.Mode) > 0 || j.Sample != 0) {
+		return fmt.Errorf("mode and sample are only used by health jobs")
+	}
+	if j.Interval < time.Minute {
+		return fmt.Errorf("interval should be at least 1m, got %s", j.Interval)
+	}
+	if j.Name == "" {
+		j.Name = j.Type + " " + j.Release + "/" + j.Repo
+		if len(j.Arch) > 0 {
+			j.Name += "/" + j.Arch
+		}
+	}
+	return nil
+}
+
+// startJobs kicks off a routine for every job, which keeps running it until
+// the returned channel gets closed.
+func startJobs(jobs []jobconfig) (stop chan struct{}) {
+	stop = make(chan struct{})
+	for _, j := range jobs {
+		info("scheduling job", "job", j.Name, "interval", j.Interval)
+		go func(j jobconfig) {
+			ticker := time.NewTicker(j.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					runJob(j)
+				}
+			}
+		}(j)
+	}
+	return
+}
+
+// runJob does a single run of a job against all mirrors, the same way the
+// repohealth and repomirror requests would.
+func runJob(j jobconfig) {
+	lc := current()
+	release := lc.resolve(j.Release)
+
+	debug("job", "status", "starting", "job", j.Name, "release", release)
+	t0 := time.Now()
+
+	for _, m := range lc.mirrors {
+		if !m.checked(j.Maintenance) || !m.serves(release, j.Repo) {
+			continue
+		}
+
+		uri := m.url + "/" + release + "/" + j.Repo
+		localrepo := release + "/" + j.Repo
+		if len(j.Arch) > 0 {
+			uri += "/" + j.Arch
+			localrepo += "/" + j.Arch
+		}
+
+		var metafailed, failed, sigfailed []string
+		var err error
+		switch j.Type {
+		case "health":
+			hc, _ := parseHealthCheck(j.Mode, j.Sample)
+			_, metafailed, failed, sigfailed, err = checkHealth(lc, uri, hc)
+		case "mirror":
+			_, failed, sigfailed, err = mirrorRepository(lc, uri, localrepo)
+		}
+
+		if err != nil {
+			warn("job failed for mirror", "job", j.Name, "mirror", m.name, "err", err.Error())
+			notify(eventJobFailed, map[string]interface{}{"job": j.Name, "type": j.Type, "mirror": m.name, "uri": uri, "error": err.Error()})
+		} else if len(metafailed) > 0 {
+			warn("job had failed metadata", "job", j.Name, "mirror", m.name, "failed", len(metafailed))
+			notify(eventJobFailed, map[string]interface{}{"job": j.Name, "type": j.Type, "mirror": m.name, "uri": uri, "metadata_failed": len(metafailed), "metadata": metafailed})
+		} else if len(failed)+len(sigfailed) > 0 {
+			warn("job had failed packages", "job", j.Name, "mirror", m.name, "failed", len(failed), "signatures", len(sigfailed))
+			// the packages which failed are limited, a broken mirror can have
+			// thousands of them
+			packages, signatures := failed, sigfailed
+			if len(packages) > 100 {
+				packages = packages[:100]
+			}
+			if len(signatures) > 100 {
+				signatures = signatures[:100]
+			}
+			notify(eventJobFailed, map[string]interface{}{"job": j.Name, "type": j.Type, "mirror": m.name, "uri": uri, "failed": len(failed), "packages": packages, "signature_failed": len(sigfailed), "signatures": signatures})
+		} else {
+			info("job succeeded for mirror", "job", j.Name, "mirror", m.name)
+		}
+	}
+
+	debug("job", "status", "done", "job", j.Name, "elapsed", time.Since(t0))
+}
@@ -5,11 +5,8 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
@@ -17,107 +14,57 @@ import (
 )
 
 var (
-	mirrors []string          // env REPO_MIRRORS="http://centos.mirror.triple-it.nl, http://mirror.dataone.nl/centos, http://mirrors.xtom.nl/centos"
-	aliases map[string]string // env RELEASE_ALIASES="7=7.6.1810, 6=6.9"
-	client  *http.Client
-
-	fetchRoutines = 16
-	version       = "0000000"
-	buildtime     = "0000000"
+	version   = "0000000"
+	buildtime = "0000000"
 )
 
 func init() {
-	// parse repo mirrors from environment variable
-	if val, ok := os.LookupEnv("REPO_MIRRORS"); !ok {
-		warn("no repository mirrors specified in REPO_MIRRORS environment variable, replies will be status 204")
-	} else {
-		mirrors = strings.Split(val, ",")
-		for i, m := range mirrors {
-			mirrors[i] = strings.TrimRight(strings.TrimSpace(m), "/")
-		}
-	}
-
-	// parse release aliases from environment variable
-	aliases = make(map[string]string)
-	if val, ok := os.LookupEnv("RELEASE_ALIASES"); !ok {
-		info("no release aliases specified in RELEASE_ALIASES environment variable, doing pass-through release names")
-	} else {
-		for _, a := range strings.Split(val, ",") {
-			a = strings.TrimSpace(a)
-			p := strings.Split(a, "=")
-			if len(p) != 2 {
-				fatal("could not parse release alias", "failed", a)
-			}
-			aliases[p[0]] = p[1]
-		}
+	var cfg *config
+	var lc *liveconfig
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		fatal("invalid configuration", "error", err.Error())
 	}
 
-	if val, set := os.LookupEnv("FETCH_ROUTINES"); set {
-		if v, err := strconv.Atoi(val); err != nil {
-			warn("unable to parse FETCH_ROUTINES", "got", val, "expect", "int")
-		} else {
-			fetchRoutines = v
-		}
+	if cfg.Debug {
+		enable_debugging()
+		debug("debugging is now enabled")
 	}
 
-	if val, set := os.LookupEnv("DEBUG"); set {
-		switch strings.ToLower(val) {
-		case "0", "no", "false":
-			// even if DEBUG is set, but the value is any of 0, no, or false,
-			// then still do not enable debug output.
-		default:
-			// in all other cases enable debugging output
-			enable_debugging()
-			debug("debugging is now enabled")
-		}
+	if lc, err = newLiveConfig(cfg); err != nil {
+		fatal("invalid configuration", "error", err.Error())
 	}
+	live.Store(lc)
 
-	var insecureSkipVerify bool
-	if val, set := os.LookupEnv("INSECURE_SKIP_VERIFY"); set {
-		switch strings.ToLower(val) {
-		case "0", "no", "false":
-			// even if INSECURE_SKIP_VERIFY is set, but the value is any of
-			// 0, no, or false, then still do not disable verification.
-			insecureSkipVerify = false
-		default:
-			// in all other cases the value is set to something that can
-			// be interpreted as "enable" the verification-skipping.
-			warn("certificate verification of mirrors with TLS support is disabled")
-			insecureSkipVerify = true
+	if len(cfg.DiffCache.File) > 0 {
+		if n, err := diffcache.load(cfg.DiffCache.File); err != nil {
+			warn("unable to load cached repodiffs", "error", err.Error())
+		} else {
+			info("loaded cached repodiffs", "file", cfg.DiffCache.File, "repodiffs", n)
 		}
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: insecureSkipVerify,
-		},
-		DisableCompression: false,
-	}
-
-	if cert, err := tls.LoadX509KeyPair("client-cert.pem", "client-key.pem"); err == nil {
-		info("Found client-TLS keypair, HTTP requests will be authenticated")
-		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
-	}
-
-	if val, set := os.LookupEnv("HTTP_PROXY"); set {
-		if httpProxyURL, err := url.Parse(val); err == nil {
-			info("Found HTTP proxy declaration, HTTP requests be sent through proxy")
-			tr.Proxy = http.ProxyURL(httpProxyURL)
+	if len(cfg.FeedFile) > 0 {
+		if n, err := loadFeeds(cfg.FeedFile); err != nil {
+			warn("unable to load feeds", "error", err.Error())
+		} else {
+			info("loaded feeds", "file", cfg.FeedFile, "feeds", n)
 		}
 	}
-
-	client = &http.Client{Transport: tr}
-
 }
 
 func main() {
 	// declare both regular and ssl capable http servers
 	var server, sslserver *http.Server
 
-	// trap signals to properly shutdown http server
+	// the listen addresses and timeouts are taken from the configuration at
+	// startup, a reload does not change them.
+	cfg := current().config
+
+	// trap signals to properly shutdown http server, or reload configuration
 	signals := make(chan os.Signal, 1)
 	defer close(signals)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// init built-in stats page (middleware will forward to muxer)
 	middleware := stats.New()
@@ -137,6 +84,18 @@ func main() {
 	// requests for '/repomirror' should be parsed as a repomirror request
 	mux.HandleFunc("/repomirror", mirrorRequest)
 
+	// requests for '/consistency' compare a repo across all mirrors
+	mux.HandleFunc("/consistency", consistencyRequest)
+
+	// requests for '/feed' publish package changes of a release as atom
+	mux.HandleFunc("/feed", feedRequest)
+
+	// requests for '/aliases' show what all aliases currently point to
+	mux.HandleFunc("/aliases", aliasesRequest)
+
+	// requests for '/admin/' manage aliases and mirrors at runtime
+	mux.HandleFunc("/admin/", adminRequest)
+
 	// handling the favicon request prevents counting all the
 	// invalid requests, just reply StatusOK and 0 bytes in the body
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -145,6 +104,10 @@ func main() {
 
 	// requests for '/health' should return a proper alive response
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if outputFormat(r) == formatJSON {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+			return
+		}
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ALIVE\n"))
@@ -172,15 +135,17 @@ func main() {
 
 	// init http server
 	server = &http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.Listen.HTTP,
 		Handler: middleware.Handler(mux),
 	}
 
 	if cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem"); err != nil {
 		info("TLS keypair not loaded, HTTPS will not be available", "reason", err.Error())
+	} else if cfg.Listen.HTTPS == "" {
+		info("no https listen address configured, HTTPS will not be available")
 	} else {
 		sslserver = &http.Server{
-			Addr:     ":8443",
+			Addr:     cfg.Listen.HTTPS,
 			Handler:  middleware.Handler(mux),
 			ErrorLog: getcontextlogger("component", "https server"),
 			TLSConfig: &tls.Config{
@@ -203,7 +168,19 @@ func main() {
 		}(sslserver, shut)
 	}
 
-	ticker := time.NewTicker(time.Second * 10)
+	// kick off any periodic jobs from the configuration, and keep
+	// snapshotting the releases of the feeds
+	reloadlock.Lock()
+	startBackground(current())
+	reloadlock.Unlock()
+	defer stopBackground()
+
+	// keep resolving the alias rules in the background
+	stoprules := make(chan struct{})
+	defer close(stoprules)
+	go watchRules(stoprules)
+
+	ticker := time.NewTicker(cfg.Timeouts.Idle)
 
 	// while the http server is up and running
 	for running := true; running; {
@@ -212,10 +189,16 @@ func main() {
 			switch sig {
 			case syscall.SIGINT, syscall.SIGTERM:
 				info("received signal", "signal", sig.String(), "action", "stopping")
-				ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 				if err := server.Shutdown(ctx); err != nil {
 					warn("http server exited without proper shutdown", "error", err.Error())
 				}
+				cancel()
+			case syscall.SIGHUP:
+				info("received signal", "signal", sig.String(), "action", "reloading")
+				if err := reloadConfig(); err != nil {
+					warn("unable to reload configuration, keeping the current one", "error", err.Error())
+				}
 			default:
 				info("received signal", "signal", sig.String(), "action", "ignoring")
 			}
@@ -225,7 +208,7 @@ func main() {
 			}
 
 			// try to shoot the other server in the head
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 			if err := server.Shutdown(ctx); err != nil {
 				warn("http server exited without proper shutdown", "error", err.Error())
 			}
@@ -234,9 +217,17 @@ func main() {
 					warn("https server exited without proper shutdown", "error", err.Error())
 				}
 			}
+			cancel()
 			running = false
 		case <-ticker.C:
-			client.CloseIdleConnections()
+			current().closeIdleConnections()
+		}
+	}
+
+	// keep the repodiffs around for the next start
+	if filename := current().DiffCache.File; len(filename) > 0 {
+		if err := diffcache.save(filename); err != nil {
+			warn("unable to save cached repodiffs", "error", err.Error())
 		}
 	}
 }
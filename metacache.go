@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+var (
+	repomdcache = &sync.Map{}
+	pkgcache    = newPkgStore()
+)
+
+// repomdentry is a repomd.xml as fetched before, along with what is needed to
+// ask the mirror whether it changed since.
+type repomdentry struct {
+	etag     string
+	modified string
+	rmd      *repomd
+}
+
+// pkgkey identifies the package metadata of a repo by the checksum repomd.xml
+// lists for it, so repos with the same metadata share it no matter which
+// mirror they are on.
+type pkgkey struct {
+	datatype string
+	checksum string
+}
+
+// pkgkeyfor returns the key for a type of metadata of a repo, and false if
+// repomd.xml lists no checksum for it.
+func pkgkeyfor(rmd *repomd, datatype string) (key pkgkey, ok bool) {
+	for _, d := range rmd.Data {
+		if d.Type == datatype && len(d.Checksum.Text) > 0 {
+			return pkgkey{datatype: datatype, checksum: d.Checksum.Type + ":" + d.Checksum.Text}, true
+		}
+	}
+	return
+}
+
+// pkgstore is a cache of parsed package metadata, which holds on to a limited
+// number of packages and evicts the least recently used repos first.
+type pkgstore struct {
+	sync.Mutex
+	entries map[pkgkey]*list.Element
+	order   *list.List // most recently used in front
+	total   int        // packages of all repos together
+}
+
+type pkgentry struct {
+	key  pkgkey
+	pkgs []*primarypkg
+}
+
+func newPkgStore() *pkgstore {
+	return &pkgstore{entries: make(map[pkgkey]*list.Element), order: list.New()}
+}
+
+// get returns the cached packages of a repo, from either its primary_db or
+// primary.xml as they hold the same packages.
+func (s *pkgstore) get(rmd *repomd) (pkgs []*primarypkg, found bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, datatype := range []string{"primary_db", "primary"} {
+		if key, ok := pkgkeyfor(rmd, datatype); ok {
+			if e, hit := s.entries[key]; hit {
+				s.order.MoveToFront(e)
+				return e.Value.(*pkgentry).pkgs, true
+			}
+		}
+	}
+	return
+}
+
+// put adds the packages of a repo, evicting the least recently used repos
+// while there are more than max packages.
+func (s *pkgstore) put(key pkgkey, pkgs []*primarypkg, max int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if e, found := s.entries[key]; found {
+		s.total -= len(e.Value.(*pkgentry).pkgs)
+		e.Value.(*pkgentry).pkgs = pkgs
+		s.order.MoveToFront(e)
+	} else {
+		s.entries[key] = s.order.PushFront(&pkgentry{key: key, pkgs: pkgs})
+	}
+	s.total += len(pkgs)
+
+	for s.total > max && s.order.Len() > 0 {
+		e := s.order.Back()
+		debug("evicting package metadata", "type", e.Value.(*pkgentry).key.datatype, "checksum", e.Value.(*pkgentry).key.checksum)
+		s.order.Remove(e)
+		delete(s.entries, e.Value.(*pkgentry).key)
+		s.total -= len(e.Value.(*pkgentry).pkgs)
+	}
+}
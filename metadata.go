@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// datareader reads decompressed metadata, closing the decompressor and the
+// http response underneath it when done.
+type datareader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *datareader) Close() (err error) {
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if e := d.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// compression formats metadata can come in
+const (
+	compressNone  = "none"
+	compressGzip  = "gzip"
+	compressXz    = "xz"
+	compressBzip2 = "bzip2"
+	compressZstd  = "zstd"
+	compressZck   = "zchunk" // recognised, but can not be decompressed
+)
+
+// errUnsupportedCompression is returned for metadata in a format which is
+// known, but which repogirl can not decompress.
+var errUnsupportedCompression = fmt.Errorf("unsupported compression")
+
+// compressions maps the file extensions createrepo uses to their format.
+var compressions = map[string]string{
+	".xml":  compressNone,
+	".gz":   compressGzip,
+	".xz":   compressXz,
+	".bz2":  compressBzip2,
+	".zst":  compressZstd,
+	".zstd": compressZstd,
+	".zck":  compressZck,
+}
+
+// sniffCompression guesses the compression of data from its first bytes,
+// assuming uncompressed data if none of them match.
+func sniffCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return compressGzip
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return compressXz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return compressBzip2
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return compressZstd
+	case bytes.HasPrefix(magic, []byte("\x00ZCK1")), bytes.HasPrefix(magic, []byte("\x00ZHR1")):
+		return compressZck
+	}
+	return compressNone
+}
+
+// decompress returns a reader for the contents of a metadata file, going by
+// its extension to tell how it is compressed or by its first few bytes if the
+// extension is unknown. closing the reader also closes r.
+func decompress(href string, r io.ReadCloser) (rc io.ReadCloser, err error) {
+	br := bufio.NewReader(r)
+	compression, known := compressions[path.Ext(href)]
+	if !known {
+		magic, _ := br.Peek(6)
+		compression = sniffCompression(magic)
+	}
+
+	d := &datareader{closers: []io.Closer{r}}
+	switch compression {
+	case compressGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		d.Reader, d.closers = zr, append(d.closers, zr)
+	case compressXz:
+		if d.Reader, err = xz.NewReader(br); err != nil {
+			return
+		}
+	case compressBzip2:
+		d.Reader = bzip2.NewReader(br)
+	case compressZstd:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(br); err != nil {
+			return
+		}
+		d.Reader, d.closers = zr, append(d.closers, zr.IOReadCloser())
+	case compressZck:
+		return nil, errUnsupportedCompression
+	default:
+		d.Reader = br
+	}
+
+	rc = d
+	return
+}
+
+// fetchRepomd fetches and parses the repomd.xml of a repo. the last version
+// of every repomd.xml is kept, and the mirror is asked only to send it again
+// if it changed since.
+func fetchRepomd(lc *liveconfig, uri string) (rmd *repomd, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest("GET", uri+"/repodata/repomd.xml", nil); err != nil {
+		err = fmt.Errorf("unable to fetch repomd.xml (%s)", err.Error())
+		return
+	}
+
+	var cached repomdentry
+	if v, found := repomdcache.Load(uri); found {
+		cached = v.(repomdentry)
+		if len(cached.etag) > 0 {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if len(cached.modified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.modified)
+		}
+	}
+
+	var resp *http.Response
+	if resp, err = lc.clientfor(uri).Do(req); err != nil {
+		err = fmt.Errorf("unable to fetch repomd.xml (%s)", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached.rmd != nil {
+		debug("repomd.xml not modified", "uri", uri)
+		return cached.rmd, nil
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unable to fetch repomd.xml (status %d)", resp.StatusCode)
+		return
+	}
+
+	var raw []byte
+	if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = fmt.Errorf("unable to fetch repomd.xml (%s)", err.Error())
+		return
+	}
+	rmd = &repomd{raw: raw}
+	if err = xml.Unmarshal(raw, rmd); err != nil {
+		err = fmt.Errorf("unable to read repomd.xml (%s)", err.Error())
+		return
+	}
+
+	if etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"); len(etag) > 0 || len(modified) > 0 {
+		lc.cache(func() { repomdcache.Store(uri, repomdentry{etag: etag, modified: modified, rmd: rmd}) })
+	} else {
+		repomdcache.Delete(uri)
+	}
+	return
+}
+
+// openData opens one of the metadata files listed in repomd.xml by its type
+// (like "primary" or "other") and returns a reader for its contents.
+func openData(lc *liveconfig, uri string, rmd *repomd, datatype string) (rc io.ReadCloser, err error) {
+	for _, d := range rmd.Data {
+		if d.Type != datatype {
+			continue
+		}
+
+		href := strings.TrimLeft(d.Location.Href, "/")
+		var resp *http.Response
+		if resp, err = lc.clientfor(uri).Get(uri + "/" + href); err != nil {
+			err = fmt.Errorf("unable to fetch %s (%s)", href, err.Error())
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("unable to fetch %s (status %d)", href, resp.StatusCode)
+			return
+		}
+
+		if rc, err = decompress(href, resp.Body); err != nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unable to decompress %s (%s)", href, err.Error())
+		}
+		return
+	}
+
+	err = fmt.Errorf("unable to find %s data in repomd.xml", datatype)
+	return
+}
+
+// eachPackage reads the packages of a repo one at a time, and calls each for
+// every one of them. the primary_db is used when the repo has one, unless
+// configured otherwise, and primary.xml when it does not or the database can
+// not be read. when configured, the packages of the last few repos read are
+// cached by the checksum of their metadata, so they are only parsed again when
+// it changes. the dependencies and files of the packages are left out, see
+// eachPackageFormat for those.
+func eachPackage(lc *liveconfig, uri string, each func(p *primarypkg)) (err error) {
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
+		return
+	}
+	return readPackages(lc, uri, rmd, false, each)
+}
+
+// eachPackageIn reads the packages of a repo like eachPackage, going by a
+// repomd.xml which was already fetched (and perhaps verified).
+func eachPackageIn(lc *liveconfig, uri string, rmd *repomd, each func(p *primarypkg)) (err error) {
+	return readPackages(lc, uri, rmd, false, each)
+}
+
+// eachPackageFormat reads the packages of a repo like eachPackage, along with
+// their dependencies and files. those add up to a lot more than the packages
+// themselves, so they are never cached.
+func eachPackageFormat(lc *liveconfig, uri string, each func(p *primarypkg)) (err error) {
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
+		return
+	}
+	return readPackages(lc, uri, rmd, true, each)
+}
+
+// readPackages reads the packages of a repo, with or without their format.
+func readPackages(lc *liveconfig, uri string, rmd *repomd, withformat bool, each func(p *primarypkg)) (err error) {
+	if pkgs, found := pkgcache.get(rmd); found && !withformat {
+		debug("using cached package metadata", "uri", uri, "packages", len(pkgs))
+		for _, p := range pkgs {
+			each(p)
+		}
+		return
+	}
+
+	// only hold on to the packages when they can be cached, which needs a key
+	// to cache them by and room for all of them
+	limit := lc.MetadataCache.Packages
+	var pkgs []*primarypkg
+	var caching bool
+	cachable := func(datatype string) bool {
+		_, ok := pkgkeyfor(rmd, datatype)
+		return ok && limit > 0 && !withformat
+	}
+	collect := func(p *primarypkg) {
+		if caching {
+			if pkgs = append(pkgs, p); len(pkgs) > limit {
+				pkgs, caching = nil, false
+			}
+		}
+		each(p)
+	}
+
+	datatype := "primary"
+	if lc.Metadata != metadataXML && hasData(rmd, "primary_db") {
+		caching = cachable("primary_db")
+		var seen bool
+		if err = eachPackageDB(lc, uri, rmd, withformat, func(p *primarypkg) {
+			seen = true
+			collect(p)
+		}); err == nil {
+			datatype = "primary_db"
+		} else if seen {
+			return
+		} else {
+			warn("unable to use primary_db, falling back to primary.xml", "uri", uri, "err", err.Error())
+		}
+	}
+
+	if datatype == "primary" {
+		pkgs, caching = nil, cachable("primary")
+		if err = eachPackageXML(lc, uri, rmd, withformat, collect); err != nil {
+			return
+		}
+	}
+
+	if caching {
+		key, _ := pkgkeyfor(rmd, datatype)
+		pkgcache.put(key, pkgs, limit)
+	}
+	return
+}
+
+// eachPackageXML reads primary.xml of a repo one package at a time. only a
+// single package is held in memory at any time, no matter how large the repo
+// is.
+func eachPackageXML(lc *liveconfig, uri string, rmd *repomd, withformat bool, each func(p *primarypkg)) (err error) {
+	var rc io.ReadCloser
+	if rc, err = openData(lc, uri, rmd, "primary"); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	dec := xml.NewDecoder(rc)
+	for {
+		var tok xml.Token
+		if tok, err = dec.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read primary.xml (%s)", err.Error())
+		}
+
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "package" {
+			var p primarypkg
+			if err = dec.DecodeElement(&p, &se); err != nil {
+				return fmt.Errorf("unable to read primary.xml (%s)", err.Error())
+			}
+			if !withformat {
+				p.Format = pkgformat{}
+			}
+			each(&p)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/xml"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,13 +18,19 @@ type repomirror struct {
 	valid     bool
 	lastcheck time.Time
 	latency   time.Duration
+	revision  string
 }
 
-func checkMirror(uri string) (success bool) {
+func checkMirror(lc *liveconfig, uri string) (success bool) {
+	return mirrorStatus(lc, uri).valid
+}
+
+// mirrorStatus returns the (cached) status of a repo on a mirror, checking it
+// again if the cached status is too old.
+func mirrorStatus(lc *liveconfig, uri string) (m repomirror) {
 	var req *http.Request
 	var resp *http.Response
 	var err error
-	var m repomirror
 
 	if v, found := mirrorcache.Load(uri); !found {
 		m = repomirror{}
@@ -31,40 +38,115 @@ func checkMirror(uri string) (success bool) {
 		m = v.(repomirror)
 	}
 
-	if time.Since(m.lastcheck) > time.Minute {
+	if time.Since(m.lastcheck) > lc.TTL.Mirror {
+		previous := m
 		// log a debug line to show caching effect in action
 		debug("updating mirror status", "uri", uri, "last check", m.lastcheck.Round(time.Second))
 
-		// assume valid replies answer within 2 seconds or they are to slow, add
-		// a timeout to the request so it will fail if not completed within the
-		// timeout
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+		// assume valid replies answer within the check timeout or they are to
+		// slow, add a timeout to the request so it will fail if not completed
+		// within the timeout
+		ctx, cancel := context.WithTimeout(context.Background(), lc.Timeouts.Check)
+		defer cancel()
 
 		// do not cache the request if for some reason a request could not be built
 		if req, err = http.NewRequest("GET", uri+"/repodata/repomd.xml", nil); err != nil {
 			warn("unable to build http request", "uri", uri)
-			return
+			return repomirror{}
 		}
 
 		// if the client returns with an error (like invalid TLS certificates)
 		// then do cache that result.
 		t0 := time.Now()
-		if resp, err = client.Do(req.WithContext(ctx)); err != nil {
+		if resp, err = lc.clientfor(uri).Do(req.WithContext(ctx)); err != nil {
 			warn("http client returned an error", "uri", req.RequestURI, "error", err)
 			m.valid = false
 		} else if resp.StatusCode != http.StatusOK {
 			// if the statuscode is anything else than OK, also cache negatively
+			resp.Body.Close()
 			m.valid = false
 		} else {
 			// only in case of statuscode being okay should cache be positive
 			m.valid = true
 			m.latency = time.Since(t0)
+
+			// the revision is only informational, so a repomd.xml which can
+			// not be parsed does not make a mirror invalid
+			var rmd repomd
+			if err = xml.NewDecoder(resp.Body).Decode(&rmd); err == nil {
+				m.revision = rmd.Revision
+			}
+			resp.Body.Close()
 		}
 		m.lastcheck = time.Now()
-		mirrorcache.Store(uri, m)
+		lc.cache(func() { mirrorcache.Store(uri, m) })
+		mirrorChanged(lc, uri, previous, m)
 	}
 
-	success = m.valid
+	return
+}
+
+// mirrorChanged sends events for whatever changed since a repo on a mirror
+// was checked before. nothing is sent the first time it is checked.
+func mirrorChanged(lc *liveconfig, uri string, previous, m repomirror) {
+	if previous.lastcheck.IsZero() {
+		return
+	}
+	var name string
+	if site := lc.mirrorfor(uri); site != nil {
+		name = site.name
+	}
+
+	switch {
+	case previous.valid && !m.valid:
+		notify(eventMirrorUnhealthy, map[string]interface{}{"mirror": name, "uri": uri, "revision": m.revision})
+	case !previous.valid && m.valid:
+		notify(eventMirrorHealthy, map[string]interface{}{"mirror": name, "uri": uri, "revision": m.revision})
+	}
+	if m.valid && len(previous.revision) > 0 && m.revision != previous.revision {
+		notify(eventRevision, map[string]interface{}{"mirror": name, "uri": uri, "revision": m.revision, "previous": previous.revision})
+	}
+}
+
+// compareRevisions compares two revisions of a repo, like strings.Compare.
+// revisions are timestamps, so they are compared as numbers. ok is false for
+// different revisions which are not both numbers, as it is not known which of
+// them is newer.
+func compareRevisions(a, b string) (cmp int, ok bool) {
+	if a == b {
+		return 0, true
+	}
+	x, errx := strconv.ParseInt(a, 10, 64)
+	y, erry := strconv.ParseInt(b, 10, 64)
+	switch {
+	case errx != nil || erry != nil:
+		return 0, false
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+// mirrorresult is the status of a single mirror in a mirrorlist.
+type mirrorresult struct {
+	Mirror   string  `json:"mirror"`
+	URI      string  `json:"uri"`
+	State    string  `json:"state"`
+	Status   string  `json:"status"` // either ok or unavailable
+	Latency  float64 `json:"latency_ms,omitempty"`
+	Revision string  `json:"revision,omitempty"`
+}
+
+func newMirrorResult(lc *liveconfig, mirror *mirrorsite, uri string) (result mirrorresult) {
+	status := mirrorStatus(lc, uri)
+	result = mirrorresult{Mirror: mirror.name, URI: uri, State: mirror.state, Status: "unavailable"}
+	if status.valid {
+		result.Status = "ok"
+		result.Latency = milliseconds(status.latency)
+		result.Revision = status.revision
+	}
 	return
 }
 
@@ -80,42 +162,90 @@ func mirrorsRequest(w http.ResponseWriter, r *http.Request) {
 	release := r.URL.Query().Get("release")
 	repo := r.URL.Query().Get("repo")
 	arch := r.URL.Query().Get("arch")
+	lc := current()
 
 	if len(release) < 1 || len(repo) < 1 {
 		warn("not enough parameters sent", "uri", r.RequestURI, "release", release, "repo", repo)
 		w.WriteHeader(http.StatusBadRequest)
-	} else if len(mirrors) < 1 {
+	} else if len(lc.mirrors) < 1 {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		if alias, ok := aliases[release]; ok {
-			release = alias
-		}
+		release = lc.resolve(release)
 
-		var resp string
+		results := make([]mirrorresult, 0)
 		var count int
-		for _, mirror := range mirrors {
-			uri := mirror + "/" + release + "/" + repo + "/"
-			if len(arch) > 0 {
-				uri += arch + "/"
+		var lastresort []*mirrorsite
+		for _, mirror := range lc.mirrors {
+			if !mirror.listed() || !mirror.serves(release, repo) {
+				continue
 			}
-			if checkMirror(uri) {
-				resp += uri + "\n"
+			// last resort mirrors are only looked at after all others
+			if mirror.state == stateLastResort {
+				lastresort = append(lastresort, mirror)
+				continue
+			}
+			result := newMirrorResult(lc, mirror, mirror.uri(release, repo, arch)+"/")
+			if result.Status == "ok" {
 				count++
 			} else {
-				warn("mirror does not have requested repo", "mirror", mirror, "release", release, "repo", repo)
+				warn("mirror does not have requested repo", "mirror", mirror.name, "release", release, "repo", repo)
+			}
+			results = append(results, result)
+		}
+
+		if count < 1 {
+			for _, mirror := range lastresort {
+				result := newMirrorResult(lc, mirror, mirror.uri(release, repo, arch)+"/")
+				if result.Status == "ok" {
+					debug("falling back to last resort mirror", "mirror", mirror.name, "release", release, "repo", repo)
+					count++
+				} else {
+					warn("mirror does not have requested repo", "mirror", mirror.name, "release", release, "repo", repo)
+				}
+				results = append(results, result)
 			}
 		}
 
+		checkStale(results)
+
+		status := http.StatusOK
 		if count > 0 {
 			debug("sending mirrors", "client", r.RemoteAddr, "up", count, "repo", repo, "release", r.URL.Query().Get("release"), "alias", release)
-			w.Header().Set("Content-Type", "text/plain")
-			w.Header().Set("Cache-Control", "max-age=3600")
-			w.Header().Set("X-Mirrors-Found", strconv.Itoa(count)+"/"+strconv.Itoa(len(mirrors)))
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(resp))
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(lc.TTL.Mirrorlist.Seconds())))
+			w.Header().Set("X-Mirrors-Found", strconv.Itoa(count)+"/"+strconv.Itoa(len(lc.mirrors)))
 		} else {
 			warn("no mirrors sent", "client", r.RemoteAddr, "repo", repo, "release", r.URL.Query().Get("release"), "alias", release)
-			w.WriteHeader(http.StatusNotFound)
+			status = http.StatusNotFound
+		}
+
+		switch outputFormat(r) {
+		case formatJSON:
+			writeJSON(w, status, map[string]interface{}{
+				"release": r.URL.Query().Get("release"),
+				"alias":   release,
+				"repo":    repo,
+				"arch":    arch,
+				"found":   count,
+				"mirrors": results,
+			})
+		case formatCSV:
+			records := [][]string{{"mirror", "uri", "state", "status", "latency_ms", "revision"}}
+			for _, m := range results {
+				records = append(records, []string{m.Mirror, m.URI, m.State, m.Status, strconv.FormatFloat(m.Latency, 'f', -1, 64), m.Revision})
+			}
+			writeCSV(w, status, records)
+		default:
+			if count < 1 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			for _, m := range results {
+				if m.Status == "ok" {
+					w.Write([]byte(m.URI + "\n"))
+				}
+			}
 		}
 	}
 }
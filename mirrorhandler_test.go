@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestCompareRevisions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		{"1543161601", "1543161601", 0, true},
+		{"1543161600", "1543161601", -1, true},
+		{"1543161602", "1543161601", 1, true},
+		{"999", "1000", -1, true},
+		{"0100", "100", 0, true},
+		{"1000", "", 0, false},
+		{"", "1000", 0, false},
+		{"", "", 0, true},
+		{"abc", "abc", 0, true},
+		{"abc", "abd", 0, false},
+		{"1000", "abc", 0, false},
+	}
+	for _, test := range tests {
+		if cmp, ok := compareRevisions(test.a, test.b); cmp != test.cmp || ok != test.ok {
+			t.Errorf("compareRevisions(%q, %q) = %d, %v, expected %d, %v", test.a, test.b, cmp, ok, test.cmp, test.ok)
+		}
+	}
+}
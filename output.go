@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// output formats which can be asked for with either the format parameter or
+// the Accept header
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// outputFormat returns the format a client would like a reply in. a format
+// parameter takes precedence over the Accept header, and plain text is what
+// everyone gets who does not ask for anything specific.
+func outputFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json":
+		return formatJSON
+	case "csv":
+		return formatCSV
+	case "text", "txt":
+		return formatText
+	}
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.Split(part, ";")[0]) {
+		case "application/json":
+			return formatJSON
+		case "text/csv":
+			return formatCSV
+		case "text/plain":
+			return formatText
+		}
+	}
+
+	return formatText
+}
+
+// flag returns whether a parameter is set to something other than 0, no or
+// false.
+func flag(r *http.Request, name string) bool {
+	val := r.URL.Query().Get(name)
+	return len(val) > 0 && !isfalse(val)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeCSV(w http.ResponseWriter, status int, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(status)
+	c := csv.NewWriter(w)
+	c.WriteAll(records)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Round(time.Microsecond)) / float64(time.Millisecond)
+}
+
+// checkresult is the outcome of a repohealth or repomirror run on a single
+// mirror.
+type checkresult struct {
+	Mirror   string   `json:"mirror"`
+	URI      string   `json:"uri"`
+	State    string   `json:"state"`
+	Status   string   `json:"status"` // one of ok, failed, error or skipped
+	Checked  int      `json:"checked"`
+	Failed   int      `json:"failed"`
+	Failures []string `json:"failures,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Elapsed  float64  `json:"elapsed_ms"`
+
+	// failures of the metadata files, which are only checked by repohealth
+	MetadataFailed   int      `json:"metadata_failed"`
+	MetadataFailures []string `json:"metadata_failures,omitempty"`
+
+	// content which is not signed by any of the trusted keys
+	SignatureFailed   int      `json:"signature_failed"`
+	SignatureFailures []string `json:"signature_failures,omitempty"`
+}
+
+// writeCheckResults sends the results of a repohealth or repomirror request
+// in the format the client asked for. notdone is what the plain text output
+// says about mirrors which returned an error.
+func writeCheckResults(w http.ResponseWriter, r *http.Request, results []checkresult, notdone string) {
+	switch outputFormat(r) {
+	case formatJSON:
+		writeJSON(w, http.StatusOK, results)
+	case formatCSV:
+		records := [][]string{{"mirror", "uri", "state", "status", "checked", "failed", "metadata_failed", "signature_failed", "error", "elapsed_ms"}}
+		for _, c := range results {
+			records = append(records, []string{
+				c.Mirror, c.URI, c.State, c.Status,
+				strconv.Itoa(c.Checked), strconv.Itoa(c.Failed), strconv.Itoa(c.MetadataFailed), strconv.Itoa(c.SignatureFailed), c.Error,
+				strconv.FormatFloat(c.Elapsed, 'f', -1, 64),
+			})
+		}
+		writeCSV(w, http.StatusOK, records)
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for _, c := range results {
+			switch c.Status {
+			case "skipped":
+				w.Write([]byte(c.URI + " SKIPPED (" + strings.ToUpper(c.State) + ")\n"))
+			case "error":
+				w.Write([]byte(c.URI + " " + notdone + "\n"))
+			case "failed":
+				if c.MetadataFailed > 0 {
+					w.Write([]byte(c.URI + " " + strconv.Itoa(c.MetadataFailed) + " FAILED METADATA FILES\n"))
+				}
+				if c.Failed > 0 {
+					w.Write([]byte(c.URI + " " + strconv.Itoa(c.Failed) + " FAILED PACKAGES\n"))
+				}
+				if c.SignatureFailed > 0 {
+					w.Write([]byte(c.URI + " " + strconv.Itoa(c.SignatureFailed) + " FAILED SIGNATURES\n"))
+				}
+			default:
+				w.Write([]byte(c.URI + " OK\n"))
+			}
+		}
+	}
+}
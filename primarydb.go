@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// eachPackageDB reads the packages of a repo from its primary_db, the sqlite
+// version of primary.xml. the database needs random access, so it is kept in a
+// temporary file while reading. the dependencies and files are only read
+// withformat, as they have to be held for every package of the repo before
+// the first package can be passed on.
+func eachPackageDB(lc *liveconfig, uri string, rmd *repomd, withformat bool, each func(p *primarypkg)) (err error) {
+	var rc io.ReadCloser
+	if rc, err = openData(lc, uri, rmd, "primary_db"); err != nil {
+		return
+	}
+	defer rc.Close()
+
+	var fh *os.File
+	if fh, err = ioutil.TempFile("", "repogirl-primary-"); err != nil {
+		return fmt.Errorf("unable to store primary_db (%s)", err.Error())
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err = io.Copy(fh, rc); err != nil {
+		return fmt.Errorf("unable to store primary_db (%s)", err.Error())
+	}
+
+	var db *sqlitedb
+	if db, err = openSqlite(fh); err != nil {
+		return
+	}
+
+	var formats map[int64]*pkgformat
+	if withformat {
+		if formats, err = readFormats(db); err != nil {
+			return
+		}
+	}
+
+	if err = db.scan("packages", func(row sqliterow) error {
+		var p primarypkg
+		p.Type = "rpm"
+		p.Name = row.text("name")
+		p.Arch = row.text("arch")
+		p.Version.Epoch = row.text("epoch")
+		p.Version.Ver = row.text("version")
+		p.Version.Rel = row.text("release")
+		p.Checksum.Text = row.text("pkgId")
+		p.Checksum.Type = row.text("checksum_type")
+		p.Checksum.Pkgid = "YES"
+		p.Time.File = int(row.int("time_file"))
+		p.Time.Build = int(row.int("time_build"))
+		p.Size.Package = int(row.int("size_package"))
+		p.Size.Installed = int(row.int("size_installed"))
+		p.Size.Archive = int(row.int("size_archive"))
+		p.Location.Href = row.text("location_href")
+		if f := formats[row.int("pkgKey")]; f != nil {
+			p.Format = *f
+		}
+		each(&p)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to read primary_db (%s)", err.Error())
+	}
+	return
+}
+
+// readFormats reads the dependencies and files of all packages in a
+// primary_db. they are in tables of their own, tied to the packages by their
+// pkgKey.
+func readFormats(db *sqlitedb) (formats map[int64]*pkgformat, err error) {
+	formats = make(map[int64]*pkgformat)
+	formatfor := func(key int64) *pkgformat {
+		if formats[key] == nil {
+			formats[key] = &pkgformat{}
+		}
+		return formats[key]
+	}
+	for _, table := range []string{"requires", "provides", "obsoletes", "conflicts"} {
+		if err = db.scan(table, func(row sqliterow) error {
+			f := formatfor(row.int("pkgKey"))
+			d := pkgdep{Name: row.text("name"), Flags: row.text("flags"), Epoch: row.text("epoch"), Ver: row.text("version"), Rel: row.text("release")}
+			switch table {
+			case "requires":
+				f.Requires = append(f.Requires, d)
+			case "provides":
+				f.Provides = append(f.Provides, d)
+			case "obsoletes":
+				f.Obsoletes = append(f.Obsoletes, d)
+			case "conflicts":
+				f.Conflicts = append(f.Conflicts, d)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("unable to read primary_db (%s)", err.Error())
+		}
+	}
+	if err = db.scan("files", func(row sqliterow) error {
+		if row.text("type") != "dir" {
+			f := formatfor(row.int("pkgKey"))
+			f.Files = append(f.Files, row.text("name"))
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read primary_db (%s)", err.Error())
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+)
+
+var (
+	// reloads from a signal and from the admin api should not overlap
+	reloadlock sync.Mutex
+
+	// held while a new configuration is swapped in and the caches are
+	// cleaned up for it, see cache
+	cachelock sync.RWMutex
+
+	// stop the jobs and feeds of the configuration in use
+	stopjobs, stopfeeds chan struct{}
+)
+
+// reloadConfig reads the configuration again and swaps it in as a whole, so
+// requests either see the old or the new mirrors and aliases, never a mix.
+// cached results for mirrors which are no longer configured are dropped.
+func reloadConfig() (err error) {
+	_, err = reloadConfigWith(nil, nil)
+	return
+}
+
+// reloadConfigWith reloads the configuration like reloadConfig, but with the
+// given admin state. once the new configuration turned out to be valid commit
+// is called, and the new configuration is only swapped in when that does not
+// fail. committed tells whether an error came from commit.
+func reloadConfigWith(st *adminstate, commit func() error) (committed bool, err error) {
+	reloadlock.Lock()
+	defer reloadlock.Unlock()
+
+	var cfg *config
+	var lc *liveconfig
+	if cfg, err = loadConfigWith(st); err != nil {
+		return
+	}
+	if lc, err = newLiveConfig(cfg); err != nil {
+		return
+	}
+	if commit != nil {
+		committed = true
+		if err = commit(); err != nil {
+			return
+		}
+	}
+
+	old := current()
+	if cfg.Listen != old.Listen || cfg.Timeouts != old.Timeouts {
+		warn("listen addresses and timeouts only change after a restart")
+	}
+
+	if cfg.Debug {
+		enable_debugging()
+	} else {
+		disable_debugging()
+	}
+
+	cachelock.Lock()
+	live.Store(lc)
+	invalidateCaches(lc)
+	cachelock.Unlock()
+	aliasesChanged(old.aliases, lc.aliases)
+
+	// jobs, feeds and alias rules might have changed as well
+	startBackground(lc)
+	reevaluateRules()
+
+	// requests still running against the old configuration keep working,
+	// idle connections of the old clients are no longer of any use though
+	old.closeIdleConnections()
+
+	info("configuration reloaded", "mirrors", len(lc.mirrors), "aliases", len(lc.aliases))
+	return
+}
+
+// cache runs store, which puts a result in one of the caches, unless lc is no
+// longer the configuration in use. results of requests which were still
+// running against an old configuration would otherwise end up in the caches
+// after they were cleaned up for the new one.
+func (lc *liveconfig) cache(store func()) {
+	cachelock.RLock()
+	defer cachelock.RUnlock()
+	if current() == lc {
+		store()
+	}
+}
+
+// startBackground starts the jobs and feeds of a configuration, after
+// stopping those of the previous one. the caller holds reloadlock.
+func startBackground(lc *liveconfig) {
+	if stopjobs != nil {
+		close(stopjobs)
+		close(stopfeeds)
+	}
+	stopjobs, stopfeeds = startJobs(lc.Jobs), startFeeds(lc.Feeds)
+}
+
+// stopBackground stops the jobs and feeds for good.
+func stopBackground() {
+	reloadlock.Lock()
+	defer reloadlock.Unlock()
+	if stopjobs != nil {
+		close(stopjobs)
+		close(stopfeeds)
+		stopjobs, stopfeeds = nil, nil
+	}
+}
+
+// invalidateCaches removes every cached result which came from a mirror (or
+// diff source) that is not part of the configuration anymore, and forgets
+// which mirrored packages were verified.
+func invalidateCaches(lc *liveconfig) {
+	mirrorcache.Range(func(k, v interface{}) bool {
+		if lc.mirrorfor(k.(string)) == nil {
+			debug("invalidating mirror status", "uri", k)
+			mirrorcache.Delete(k)
+		}
+		return true
+	})
+
+	repomdcache.Range(func(k, v interface{}) bool {
+		if lc.mirrorfor(k.(string)) == nil {
+			repomdcache.Delete(k)
+		}
+		return true
+	})
+
+	diffcache.drop(func(d repodiff) bool {
+		if !lc.diffable(d.olduri) || !lc.diffable(d.newuri) {
+			debug("invalidating repodiff", "old", d.olduri, "new", d.newuri)
+			return true
+		}
+		return false
+	})
+
+	// the trusted keys may have changed, so mirrored packages are verified
+	// again the next time
+	verifiedfiles.Range(func(k, v interface{}) bool {
+		verifiedfiles.Delete(k)
+		return true
+	})
+}
+
+// aliasesChanged sends an event for every alias which points to another
+// release than before, or is gone altogether.
+func aliasesChanged(old, aliases map[string]string) {
+	for name, release := range aliases {
+		if old[name] != release {
+			notify(eventAliasChanged, map[string]interface{}{"alias": name, "release": release, "previous": old[name]})
+		}
+	}
+	for name, release := range old {
+		if _, found := aliases[name]; !found {
+			notify(eventAliasChanged, map[string]interface{}{"alias": name, "release": "", "previous": release})
+		}
+	}
+}
+
+// closeIdleConnections closes the idle connections of all clients.
+func (lc *liveconfig) closeIdleConnections() {
+	lc.client.CloseIdleConnections()
+	for _, m := range lc.mirrors {
+		m.client.CloseIdleConnections()
+	}
+	for _, c := range lc.webhookclients {
+		c.CloseIdleConnections()
+	}
+}
@@ -1,82 +1,86 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/xml"
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var (
-	diffcache = &sync.Map{}
-)
-
 type repomd struct {
-	XMLName  xml.Name `xml:"repomd"`
-	Xmlns    string   `xml:"xmlns,attr"`
-	Rpm      string   `xml:"rpm,attr"`
-	Revision string   `xml:"revision"`
-	Data     []struct {
-		Type     string `xml:"type,attr"`
-		Checksum struct {
-			Text string `xml:",chardata"`
-			Type string `xml:"type,attr"`
-		} `xml:"checksum"`
-		Location struct {
-			Href string `xml:"href,attr"`
-		} `xml:"location"`
-		Timestamp    string `xml:"timestamp"`
-		Size         string `xml:"size"`
-		OpenChecksum struct {
-			Text string `xml:",chardata"`
-			Type string `xml:"type,attr"`
-		} `xml:"open-checksum"`
-		OpenSize        string `xml:"open-size"`
-		DatabaseVersion string `xml:"database_version"`
-	} `xml:"data"`
+	XMLName  xml.Name   `xml:"repomd"`
+	Xmlns    string     `xml:"xmlns,attr"`
+	Rpm      string     `xml:"rpm,attr"`
+	Revision string     `xml:"revision"`
+	Data     []repodata `xml:"data"`
+
+	raw []byte // repomd.xml as it was fetched, which its signature is made over
+}
+
+// repodata is one of the metadata files listed in repomd.xml.
+type repodata struct {
+	Type     string `xml:"type,attr"`
+	Checksum struct {
+		Text string `xml:",chardata"`
+		Type string `xml:"type,attr"`
+	} `xml:"checksum"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Timestamp    string `xml:"timestamp"`
+	Size         string `xml:"size"`
+	OpenChecksum struct {
+		Text string `xml:",chardata"`
+		Type string `xml:"type,attr"`
+	} `xml:"open-checksum"`
+	OpenSize        string `xml:"open-size"`
+	DatabaseVersion string `xml:"database_version"`
 }
 
-type pkgmd struct {
-	XMLName  xml.Name `xml:"metadata"`
-	Xmlns    string   `xml:"xmlns,attr"`
-	Rpm      string   `xml:"rpm,attr"`
-	Packages string   `xml:"packages,attr"` // number of packages
-	Package  []struct {
-		Text    string `xml:",chardata"`
-		Type    string `xml:"type,attr"`
-		Name    string `xml:"name"`
-		Arch    string `xml:"arch"`
-		Version struct {
-			Epoch string `xml:"epoch,attr"`
-			Ver   string `xml:"ver,attr"`
-			Rel   string `xml:"rel,attr"`
-		} `xml:"version"`
-		Checksum struct {
-			Text  string `xml:",chardata"`
-			Type  string `xml:"type,attr"`
-			Pkgid string `xml:"pkgid,attr"`
-		} `xml:"checksum"`
-		// Summary     string `xml:"summary"`
-		// Description string `xml:"description"`
-		// Packager    string `xml:"packager"`
-		// URL         string `xml:"url"`
-		Time struct {
-			File  int `xml:"file,attr"`
-			Build int `xml:"build,attr"`
-		} `xml:"time"`
-		Size struct {
-			Package   int `xml:"package,attr"`
-			Installed int `xml:"installed,attr"`
-			Archive   int `xml:"archive,attr"`
-		} `xml:"size"`
-		Location struct {
-			Href string `xml:"href,attr"`
-		} `xml:"location"`
-	} `xml:"package"`
+// primarypkg is a single package in primary.xml.
+type primarypkg struct {
+	Type    string `xml:"type,attr"`
+	Name    string `xml:"name"`
+	Arch    string `xml:"arch"`
+	Version struct {
+		Epoch string `xml:"epoch,attr"`
+		Ver   string `xml:"ver,attr"`
+		Rel   string `xml:"rel,attr"`
+	} `xml:"version"`
+	Checksum struct {
+		Text  string `xml:",chardata"`
+		Type  string `xml:"type,attr"`
+		Pkgid string `xml:"pkgid,attr"`
+	} `xml:"checksum"`
+	// Summary     string `xml:"summary"`
+	// Description string `xml:"description"`
+	// Packager    string `xml:"packager"`
+	// URL         string `xml:"url"`
+	Time struct {
+		File  int `xml:"file,attr"`
+		Build int `xml:"build,attr"`
+	} `xml:"time"`
+	Size struct {
+		Package   int `xml:"package,attr"`
+		Installed int `xml:"installed,attr"`
+		Archive   int `xml:"archive,attr"`
+	} `xml:"size"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Format pkgformat `xml:"format"`
+}
+
+// vers returns the version of a package, with an epoch of 0 if it has none.
+func (p *primarypkg) vers() (v pkgvers) {
+	v = pkgvers{epoch: p.Version.Epoch, ver: p.Version.Ver, rel: p.Version.Rel, time: p.Time.Build, checksum: p.Checksum.Text}
+	if v.epoch == "" {
+		v.epoch = "0"
+	}
+	return
 }
 
 type pkgshort struct {
@@ -85,217 +89,589 @@ type pkgshort struct {
 }
 
 type pkgvers struct {
-	ver  string
-	rel  string
-	time int
+	epoch    string
+	ver      string
+	rel      string
+	time     int
+	checksum string
+	repo     string // which repo the package came from, in aggregate diffs
+	href     string // where the package file is, relative to the repo
 }
 
-type repodiff struct {
-	lastcheck time.Time
-	added     []string
-	changed   []string
-	removed   []string
-}
+// kinds of changes between two versions of the same package
+const (
+	changeDowngrade = "downgrade" // the new evr is older than the old one
+	changeUpgrade   = "upgrade"   // the epoch or version went up
+	changeRelease   = "release"   // only the release went up
+	changeRebuild   = "rebuild"   // same evr, but a different checksum or build time
+)
 
-func fetchPackageMetadata(uri string) (pkgsmd *pkgmd, err error) {
-	var resp *http.Response
-	if resp, err = client.Get(uri + "/repodata/repomd.xml"); err != nil {
-		err = fmt.Errorf("unable to fetch repomd.xml (%s)", err.Error())
-		return
+// classify returns what kind of change going from one version to another is.
+func classify(oldvers, newvers pkgvers) string {
+	switch c := newvers.cmp(oldvers); {
+	case c < 0:
+		return changeDowngrade
+	case c == 0:
+		return changeRebuild
+	case evrcmp(oldvers.epoch, oldvers.ver, "", newvers.epoch, newvers.ver, "") == 0:
+		return changeRelease
 	}
-	defer resp.Body.Close()
+	return changeUpgrade
+}
 
-	var rmd *repomd
-	if err = xml.NewDecoder(resp.Body).Decode(&rmd); err != nil {
-		err = fmt.Errorf("unable to read repomd.xml (%s)", err.Error())
-		return
+// cmp compares two versions of a package the way rpm would.
+func (v pkgvers) cmp(o pkgvers) int {
+	return evrcmp(v.epoch, v.ver, v.rel, o.epoch, o.ver, o.rel)
+}
+
+// newer returns whether a version supersedes another. the build time only
+// decides between builds of the same evr.
+func (v pkgvers) newer(o pkgvers) bool {
+	c := v.cmp(o)
+	return c > 0 || (c == 0 && v.time > o.time)
+}
+
+// same returns whether two versions are the same build, regardless of the
+// repo they are in.
+func (v pkgvers) same(o pkgvers) bool {
+	return v.epoch == o.epoch && v.ver == o.ver && v.rel == o.rel && v.time == o.time && v.checksum == o.checksum
+}
+
+// nevra identifies a single build of a package.
+type nevra struct {
+	Name    string `json:"name"`
+	Epoch   string `json:"epoch"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+
+	Checksum string `json:"checksum,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+}
+
+// String returns the package as name-[epoch:]version-release.arch, leaving
+// out the epoch if it is 0 like rpm does.
+func (p nevra) String() string {
+	if p.Epoch != "" && p.Epoch != "0" {
+		return p.Name + "-" + p.Epoch + ":" + p.Version + "-" + p.Release + "." + p.Arch
 	}
+	return p.Name + "-" + p.Version + "-" + p.Release + "." + p.Arch
+}
 
-	for _, d := range rmd.Data {
-		if d.Type == "primary" {
-			// fetch the primary data from the repo
-			var resp *http.Response
-			if resp, err = client.Get(uri + "/" + strings.TrimLeft(d.Location.Href, "/")); err != nil {
-				err = fmt.Errorf("unable to fetch filelist (%s)", err.Error())
-				return
-			}
-			defer resp.Body.Close()
+type pkgchange struct {
+	Type string `json:"type"`
+	Old  nevra  `json:"old"`
+	New  nevra  `json:"new"`
 
-			// tie the gzipped data to a gzip.Reader
-			var respzip *gzip.Reader
-			if respzip, err = gzip.NewReader(resp.Body); err != nil {
-				err = fmt.Errorf("unable to decompress primary.xml.gz (%s)", err.Error())
-				return
-			}
-			defer respzip.Close()
+	Changelog []changelogentry `json:"changelog,omitempty"`
+}
 
-			if err = xml.NewDecoder(respzip).Decode(&pkgsmd); err != nil {
-				err = fmt.Errorf("unable to read filelist from primary.xml (%s)", err.Error())
-				return
-			}
+func (c pkgchange) String() string {
+	return c.Old.String() + " -> " + c.New.String()
+}
 
-			return pkgsmd, err
-		}
+// origin returns which repo a package came from in an aggregate diff, to put
+// after it in text output.
+func (p nevra) origin() string {
+	if len(p.Repo) > 0 {
+		return " [" + p.Repo + "]"
 	}
+	return ""
+}
 
-	err = fmt.Errorf("unable to find primary filelist in repomd.xml")
-	return
+// origin returns which repo a changed package came from in an aggregate
+// diff, or both repos if it moved between them.
+func (c pkgchange) origin() string {
+	if c.Old.Repo != c.New.Repo {
+		return " [" + c.Old.Repo + " -> " + c.New.Repo + "]"
+	}
+	return c.New.origin()
 }
 
-func fetchFileLists(uri string) (resultchan chan map[pkgshort]pkgvers) {
-	resultchan = make(chan map[pkgshort]pkgvers)
-	go func(c chan map[pkgshort]pkgvers) {
+func (p pkgshort) nevra(v pkgvers) nevra {
+	return nevra{Name: p.name, Epoch: v.epoch, Version: v.ver, Release: v.rel, Arch: p.arch, Checksum: v.checksum, Repo: v.repo}
+}
+
+type repodiff struct {
+	lastcheck   time.Time
+	olduri      string
+	newuri      string
+	oldrevision string
+	newrevision string
+	added       []nevra
+	changed     []pkgchange
+	removed     []nevra
+	changelogs  bool // whether changed packages have their changelog filled in
+
+	advisories    []advisory
+	hasadvisories bool // whether advisories have been filled in
+
+	depchanges  []depchange
+	unsatisfied []unsatisfied
+	deps        bool   // whether dependency changes have been filled in
+	depsagainst string // the extra repos requirements were resolved against
+
+	filechanges []filechange
+	files       bool   // whether file changes have been filled in
+	filesprefix string // the path prefix the file changes are limited to
+}
+
+// pkgset is the packages of a repo, along with the error which stopped them
+// from being read completely. a set with an error is never the whole repo.
+type pkgset struct {
+	pkgs map[pkgshort]pkgvers
+	err  error
+}
+
+func fetchFileLists(lc *liveconfig, uri, label string) (resultchan chan pkgset) {
+	resultchan = make(chan pkgset)
+	go func(c chan pkgset) {
 		defer close(c)
 		result := make(map[pkgshort]pkgvers)
-		if pkgsmd, err := fetchPackageMetadata(uri); err != nil {
-			warn("error while fetching filelists", "err", err.Error())
-		} else {
-			for _, p := range pkgsmd.Package {
-				entry := pkgshort{name: p.Name, arch: p.Arch}
-				if first, dup := result[entry]; dup {
-					if p.Time.Build > first.time {
-						// superceded package information found, so update
-						result[entry] = pkgvers{ver: p.Version.Ver, rel: p.Version.Rel, time: p.Time.Build}
-					}
-				} else {
-					result[entry] = pkgvers{ver: p.Version.Ver, rel: p.Version.Rel, time: p.Time.Build}
-				}
+		err := eachPackage(lc, uri, func(p *primarypkg) {
+			entry := pkgshort{name: p.Name, arch: p.Arch}
+			vers := p.vers()
+			vers.repo, vers.href = label, p.Location.Href
+			// superceded package information found, so update
+			if first, dup := result[entry]; !dup || vers.newer(first) {
+				result[entry] = vers
 			}
+		})
+		if err != nil {
+			err = fmt.Errorf("unable to fetch packages of %s (%s)", uri, err.Error())
 		}
-		c <- result
+		c <- pkgset{pkgs: result, err: err}
 	}(resultchan)
 
 	return resultchan
 }
 
-func mirrordiff(releaseold, releasenew string) (added, changed, removed []string) {
-	oldchan := fetchFileLists(releaseold)
-	newchan := fetchFileLists(releasenew)
+// reposource is one of the repos making up a side of a repodiff, along with
+// the label its packages are marked with.
+type reposource struct {
+	label string
+	uri   string
+}
 
-	pkgold := <-oldchan
-	pkgnew := <-newchan
+// fetchPackageSet fetches the packages of all repos of one side of a diff at
+// once and merges them. the newest build of a package wins, no matter which
+// repo it is in.
+func fetchPackageSet(lc *liveconfig, sources []reposource) (result map[pkgshort]pkgvers, err error) {
+	chans := make([]chan pkgset, len(sources))
+	for i, s := range sources {
+		chans[i] = fetchFileLists(lc, s.uri, s.label)
+	}
 
-	changed = make([]string, 0)
-	for p, newvers := range pkgnew {
-		if oldvers, found := pkgold[p]; found {
-			if oldvers != newvers {
-				changed = append(changed, p.name+"-"+oldvers.ver+"-"+oldvers.rel+"."+p.arch+" -> "+p.name+"-"+newvers.ver+"-"+newvers.rel+"."+p.arch)
+	// every channel is read, even after an error, so no fetch is left
+	// waiting to send its result
+	result = make(map[pkgshort]pkgvers)
+	for _, c := range chans {
+		set := <-c
+		if set.err != nil {
+			err = set.err
+			continue
+		}
+		for p, vers := range set.pkgs {
+			if first, dup := result[p]; !dup || vers.newer(first) {
+				result[p] = vers
 			}
-			delete(pkgnew, p)
-			delete(pkgold, p)
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
 
-	added = make([]string, 0)
-	for p, newvers := range pkgnew {
-		added = append(added, p.name+"-"+newvers.ver+"-"+newvers.rel+"."+p.arch)
+func mirrordiff(lc *liveconfig, releaseold, releasenew string) (added []nevra, changed []pkgchange, removed []nevra, err error) {
+	return aggregatediff(lc, []reposource{{uri: releaseold}}, []reposource{{uri: releasenew}})
+}
+
+// aggregatediff diffs the packages of two sets of repos. when either side
+// could not be read completely there is no diff, as the packages which were
+// not read would show up as added or removed.
+func aggregatediff(lc *liveconfig, sourcesold, sourcesnew []reposource) (added []nevra, changed []pkgchange, removed []nevra, err error) {
+	oldchan := make(chan pkgset)
+	go func() {
+		pkgs, err := fetchPackageSet(lc, sourcesold)
+		oldchan <- pkgset{pkgs: pkgs, err: err}
+	}()
+	pkgnew, errnew := fetchPackageSet(lc, sourcesnew)
+	old := <-oldchan
+	if err = old.err; err == nil {
+		err = errnew
+	}
+	if err != nil {
+		return
 	}
+	added, changed, removed = diffPackageSets(old.pkgs, pkgnew)
+	return
+}
 
-	removed = make([]string, 0)
+// diffPackageSets compares two sets of packages, leaving both as they are.
+func diffPackageSets(pkgold, pkgnew map[pkgshort]pkgvers) (added []nevra, changed []pkgchange, removed []nevra) {
+	added, changed, removed = make([]nevra, 0), make([]pkgchange, 0), make([]nevra, 0)
+	for p, newvers := range pkgnew {
+		if oldvers, found := pkgold[p]; !found {
+			added = append(added, p.nevra(newvers))
+		} else if !oldvers.same(newvers) {
+			changed = append(changed, pkgchange{Type: classify(oldvers, newvers), Old: p.nevra(oldvers), New: p.nevra(newvers)})
+		}
+	}
 	for p, oldvers := range pkgold {
-		removed = append(removed, p.name+"-"+oldvers.ver+"-"+oldvers.rel+"."+p.arch)
+		if _, found := pkgnew[p]; !found {
+			removed = append(removed, p.nevra(oldvers))
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].String() < added[j].String() })
+	// downgrades go first, they usually mean something is wrong and should
+	// not get lost in between everything else
+	sort.Slice(changed, func(i, j int) bool {
+		if (changed[i].Type == changeDowngrade) != (changed[j].Type == changeDowngrade) {
+			return changed[i].Type == changeDowngrade
+		}
+		return changed[i].String() < changed[j].String()
+	})
+	sort.Slice(removed, func(i, j int) bool { return removed[i].String() < removed[j].String() })
+	return
+}
+
+// count returns how many changed packages are of a kind of change.
+func (d repodiff) count(kind string) (n int) {
+	for _, c := range d.changed {
+		if c.Type == kind {
+			n++
+		}
+	}
+	return
+}
+
+// writeDiff sends a repodiff in the format the client asked for.
+func writeDiff(w http.ResponseWriter, r *http.Request, diff repodiff, releaseold, releasenew string) {
+	// leave out the changelogs if they were cached but not asked for
+	if !flag(r, "changelog") {
+		changed := make([]pkgchange, len(diff.changed))
+		for i, c := range diff.changed {
+			c.Changelog = nil
+			changed[i] = c
+		}
+		diff.changed = changed
+	}
+
+	// advisories are only shown when asked for, possibly only security ones
+	var advisories []advisory
+	if flag(r, "advisories") {
+		advisories = filterAdvisories(diff.advisories, strings.ToLower(r.URL.Query().Get("advisories")))
+	}
+
+	switch outputFormat(r) {
+	case formatJSON:
+		reply := map[string]interface{}{
+			"old": map[string]string{
+				"release":  r.URL.Query().Get("old"),
+				"alias":    releaseold,
+				"uri":      diff.olduri,
+				"revision": diff.oldrevision,
+			},
+			"new": map[string]string{
+				"release":  r.URL.Query().Get("new"),
+				"alias":    releasenew,
+				"uri":      diff.newuri,
+				"revision": diff.newrevision,
+			},
+			"repo":        r.URL.Query().Get("repo"),
+			"arch":        r.URL.Query().Get("arch"),
+			"age_seconds": int(time.Since(diff.lastcheck).Seconds()),
+			"counts": map[string]int{
+				"added":     len(diff.added),
+				"changed":   len(diff.changed),
+				"removed":   len(diff.removed),
+				"upgrade":   diff.count(changeUpgrade),
+				"release":   diff.count(changeRelease),
+				"rebuild":   diff.count(changeRebuild),
+				"downgrade": diff.count(changeDowngrade),
+			},
+			"added":   diff.added,
+			"changed": diff.changed,
+			"removed": diff.removed,
+		}
+		if advisories != nil {
+			reply["advisories"] = advisories
+		}
+		if flag(r, "files") {
+			reply["files"] = diff.filechanges
+		}
+		if flag(r, "deps") {
+			reply["dependencies"] = diff.depchanges
+			reply["unsatisfied"] = diff.unsatisfied
+		}
+		writeJSON(w, http.StatusOK, reply)
+	case formatCSV:
+		records := [][]string{{"change", "name", "arch", "old_epoch", "old_version", "old_release", "new_epoch", "new_version", "new_release", "old_repo", "new_repo"}}
+		for _, p := range diff.added {
+			records = append(records, []string{"added", p.Name, p.Arch, "", "", "", p.Epoch, p.Version, p.Release, "", p.Repo})
+		}
+		for _, c := range diff.changed {
+			records = append(records, []string{c.Type, c.New.Name, c.New.Arch, c.Old.Epoch, c.Old.Version, c.Old.Release, c.New.Epoch, c.New.Version, c.New.Release, c.Old.Repo, c.New.Repo})
+		}
+		for _, p := range diff.removed {
+			records = append(records, []string{"removed", p.Name, p.Arch, p.Epoch, p.Version, p.Release, "", "", "", p.Repo, ""})
+		}
+		writeCSV(w, http.StatusOK, records)
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		if len(diff.added)+len(diff.changed)+len(diff.removed) > 0 {
+			for _, p := range diff.added {
+				w.Write([]byte("+ " + p.String() + p.origin() + "\n"))
+			}
+			for _, c := range diff.changed {
+				if c.Type == changeDowngrade {
+					w.Write([]byte("! " + c.String() + " (DOWNGRADE)" + c.origin() + "\n"))
+				} else {
+					w.Write([]byte("  " + c.String() + " (" + c.Type + ")" + c.origin() + "\n"))
+				}
+				w.Write([]byte(formatChangelog(c.Changelog)))
+			}
+			for _, p := range diff.removed {
+				w.Write([]byte("- " + p.String() + p.origin() + "\n"))
+			}
+		} else {
+			w.Write([]byte("no changes in packages\n"))
+		}
+		if flag(r, "files") {
+			w.Write([]byte(formatFiles(diff.filechanges)))
+		}
+		if flag(r, "deps") {
+			w.Write([]byte(formatDeps(diff.depchanges, diff.unsatisfied)))
+		}
+		for _, a := range advisories {
+			w.Write([]byte(formatAdvisory(a)))
+		}
 	}
+}
 
-	sort.Strings(added)
-	sort.Strings(changed)
-	sort.Strings(removed)
+// splitList splits a comma separated parameter, like a list of repos.
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		list = append(list, strings.TrimSpace(v))
+	}
 	return
 }
 
+// revisions returns the repomd revisions of all repos of one side of a diff,
+// so a change to any of them makes for a new diff.
+func revisions(lc *liveconfig, sources []reposource) string {
+	revs := make([]string, len(sources))
+	for i, s := range sources {
+		revs[i] = mirrorStatus(lc, s.uri).revision
+	}
+	return strings.Join(revs, ",")
+}
+
+// knownRevisions returns whether the revisions of every repo of one side of a
+// diff are known. a repo of which repomd.xml could not be fetched has none, so
+// the revisions say nothing about what the diff is of.
+func knownRevisions(revs string) bool {
+	for _, rev := range strings.Split(revs, ",") {
+		if len(rev) < 1 {
+			return false
+		}
+	}
+	return true
+}
+
 func diffRequest(w http.ResponseWriter, r *http.Request) {
 	releaseold := r.URL.Query().Get("old")
 	releasenew := r.URL.Query().Get("new")
+	uriold := r.URL.Query().Get("olduri")
+	urinew := r.URL.Query().Get("newuri")
 	repo := r.URL.Query().Get("repo")
 	arch := r.URL.Query().Get("arch")
-	mirrorsold := make([]string, 0)
-	mirrorsnew := make([]string, 0)
+	var mirrorsold, mirrorsnew []string
+	lc := current()
 
-	if len(releaseold) < 1 || len(releasenew) < 1 || len(repo) < 1 {
+	// either side can be a release of a repo on the mirrors, or a repo
+	// given by its uri
+	if (len(releaseold) < 1 && len(uriold) < 1) || (len(releasenew) < 1 && len(urinew) < 1) || (len(repo) < 1 && (len(uriold) < 1 || len(urinew) < 1)) {
 		warn("not enough parameters sent", "uri", r.RequestURI, "old", releaseold, "new", releasenew, "repo", repo)
 		w.WriteHeader(http.StatusBadRequest)
-	} else if len(mirrors) < 1 {
+	} else if len(lc.mirrors) < 1 && (len(uriold) < 1 || len(urinew) < 1) {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		if alias, ok := aliases[releaseold]; ok {
-			releaseold = alias
+		var forbidden bool
+		if len(uriold) > 0 {
+			releaseold = sourceURI(uriold)
+		} else {
+			releaseold = lc.resolve(releaseold)
 		}
-		if alias, ok := aliases[releasenew]; ok {
-			releasenew = alias
+		if len(urinew) > 0 {
+			releasenew = sourceURI(urinew)
+		} else {
+			releasenew = lc.resolve(releasenew)
 		}
 
-		var diff repodiff
-		if tdiff, found := diffcache.Load(releaseold + releasenew + repo + arch); found {
-			diff = tdiff.(repodiff)
-		} else {
-			for _, mirror := range mirrors {
-				uri := mirror + "/" + releaseold + "/" + repo
-				if len(arch) > 0 {
-					uri += "/" + arch
-				}
-				if checkMirror(uri) {
-					mirrorsold = append(mirrorsold, uri)
-				} else {
-					warn("mirror does not have requested repo", "mirror", mirror, "release", releaseold, "repo", repo)
-				}
-			}
+		// repo and arch can be lists, in which case the packages of all their
+		// combinations are merged on each side
+		repos, arches := splitList(repo), splitList(arch)
+		aggregate := len(repos) > 1 || len(arches) > 1
+		if aggregate && (len(uriold) > 0 || len(urinew) > 0) {
+			warn("aggregate repodiff is only possible between releases", "uri", r.RequestURI)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if aggregate && (flag(r, "changelog") || flag(r, "advisories") || flag(r, "deps") || flag(r, "files")) {
+			warn("aggregate repodiff does not support changelogs, advisories, deps or files", "uri", r.RequestURI)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if prefix := r.URL.Query().Get("files"); flag(r, "files") && (!strings.HasPrefix(prefix, "/") || prefix == "/") {
+			warn("files of a repodiff need a path below /", "uri", r.RequestURI, "files", prefix)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-			if len(mirrorsold) > 0 {
-				for _, mirror := range mirrors {
-					uri := mirror + "/" + releasenew + "/" + repo
-					if len(arch) > 0 {
-						uri += "/" + arch
-					}
-					if checkMirror(uri) {
-						mirrorsnew = append(mirrorsnew, uri)
-					} else {
-						warn("mirror does not have requested repo", "mirror", mirror, "release", releasenew, "repo", repo)
+		// a combination which is missing on one side still counts on the
+		// other, like an updates repo which did not exist yet
+		sourcesold, sourcesnew := make([]reposource, 0), make([]reposource, 0)
+		for _, rp := range repos {
+			for _, a := range arches {
+				var label string
+				if aggregate {
+					if label = rp; len(arches) > 1 {
+						label += "/" + a
 					}
 				}
+
+				if mirrorsold, forbidden = diffSources(lc, releaseold, uriold, rp, a); forbidden {
+					warn("source not allowed for repodiff", "client", r.RemoteAddr, "uri", uriold)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				} else if len(mirrorsold) > 0 {
+					sourcesold = append(sourcesold, reposource{label: label, uri: mirrorsold[0]})
+				}
+				if mirrorsnew, forbidden = diffSources(lc, releasenew, urinew, rp, a); forbidden {
+					warn("source not allowed for repodiff", "client", r.RemoteAddr, "uri", urinew)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				} else if len(mirrorsnew) > 0 {
+					sourcesnew = append(sourcesnew, reposource{label: label, uri: mirrorsnew[0]})
+				}
 			}
+		}
 
-			// mirrorsnew only gets filled if mirrorsold had at least one mirror
-			// so it's safe to check just the mirrorsnew
-			if len(mirrorsnew) > 0 {
+		var diff repodiff
+		var key diffkey
+		var cachable bool
+		store := func() {
+			if cachable {
+				lc.cache(func() { diffcache.put(key, diff) })
+			}
+		}
+		if len(sourcesold) > 0 && len(sourcesnew) > 0 {
+			key = diffkey{
+				Old: releaseold, New: releasenew, Repo: strings.Join(repos, ","), Arch: strings.Join(arches, ","),
+				OldRevision: revisions(lc, sourcesold),
+				NewRevision: revisions(lc, sourcesnew),
+			}
+			// a diff is only cached when it is known which revisions it is
+			// of, otherwise it could be served long after it was fixed
+			cachable = knownRevisions(key.OldRevision) && knownRevisions(key.NewRevision)
+			var found bool
+			if cachable {
+				diff, found = diffcache.get(key)
+			}
+			if !found {
 				debug("diffing packages",
 					"client", r.RemoteAddr,
 					"repo", repo,
+					"arch", arch,
 					"old", r.URL.Query().Get("old"),
 					"aliasold", releaseold,
 					"new", r.URL.Query().Get("new"),
 					"aliasnew", releasenew,
 				)
 				diff.lastcheck = time.Now()
-				diff.added, diff.changed, diff.removed = mirrordiff(mirrorsold[0], mirrorsnew[0])
-				diffcache.Store(releaseold+releasenew+repo+arch, diff)
+				diff.olduri, diff.newuri = sourcesold[0].uri, sourcesnew[0].uri
+				diff.oldrevision, diff.newrevision = key.OldRevision, key.NewRevision
+				var err error
+				if diff.added, diff.changed, diff.removed, err = aggregatediff(lc, sourcesold, sourcesnew); err != nil {
+					warn("unable to diff repos", "repo", repo, "old", releaseold, "new", releasenew, "err", err.Error())
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				if n := diff.count(changeDowngrade); n > 0 {
+					warn("packages downgraded between releases", "repo", repo, "old", releaseold, "new", releasenew, "downgrades", n)
+				}
+				store()
 			}
 		}
 
-		if !diff.lastcheck.IsZero() {
-			w.Header().Set("Content-Type", "text/plain")
-			w.Header().Set("Cache-Control", "max-age=86400")
-			w.Header().Set("X-Content-Age", time.Since(diff.lastcheck).Round(time.Second).String())
-			w.WriteHeader(http.StatusOK)
-			if len(diff.added)+len(diff.changed)+len(diff.removed) > 0 {
-				if len(diff.added) > 0 {
-					w.Write([]byte("+ " + strings.Join(diff.added, "\n+ ") + "\n"))
+		// changelogs are only fetched when asked for, but once fetched they
+		// are kept in the cache along with the rest of the diff
+		if !diff.lastcheck.IsZero() && !diff.changelogs && flag(r, "changelog") {
+			if err := addChangelogs(lc, &diff); err != nil {
+				warn("unable to add changelogs to repodiff", "repo", repo, "old", releaseold, "new", releasenew, "err", err.Error())
+			} else {
+				store()
+			}
+		}
+
+		// the same goes for the advisories from updateinfo.xml
+		if !diff.lastcheck.IsZero() && !diff.hasadvisories && flag(r, "advisories") {
+			if err := addAdvisories(lc, &diff); err != nil {
+				warn("unable to add advisories to repodiff", "repo", repo, "old", releaseold, "new", releasenew, "err", err.Error())
+			} else {
+				store()
+			}
+		}
+
+		// and for the dependencies, which are resolved against the new repo
+		// and any other repos of the new release asked for
+		if !diff.lastcheck.IsZero() && flag(r, "deps") {
+			extra := make([]string, 0)
+			if m := lc.mirrorfor(diff.newuri); m != nil && len(r.URL.Query().Get("against")) > 0 {
+				for _, other := range strings.Split(r.URL.Query().Get("against"), ",") {
+					extra = append(extra, m.uri(releasenew, strings.TrimSpace(other), arch))
 				}
-				if len(diff.changed) > 0 {
-					w.Write([]byte("  " + strings.Join(diff.changed, "\n  ") + "\n"))
+			}
+			if !diff.deps || diff.depsagainst != strings.Join(extra, " ") {
+				if err := addDeps(lc, &diff, extra); err != nil {
+					warn("unable to add dependencies to repodiff", "repo", repo, "old", releaseold, "new", releasenew, "err", err.Error())
+				} else {
+					store()
 				}
-				if len(diff.removed) > 0 {
-					w.Write([]byte("- " + strings.Join(diff.removed, "\n- ") + "\n"))
+			}
+		}
+
+		// files are always limited to a path, since all files of a repo add
+		// up to a lot
+		if !diff.lastcheck.IsZero() && flag(r, "files") {
+			prefix := r.URL.Query().Get("files")
+			if !diff.files || diff.filesprefix != prefix {
+				if err := addFiles(lc, &diff, prefix); err == errTooManyFiles {
+					warn("too many files for repodiff", "repo", repo, "old", releaseold, "new", releasenew, "files", prefix, "max", maxfiles)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				} else if err != nil {
+					warn("unable to add files to repodiff", "repo", repo, "old", releaseold, "new", releasenew, "err", err.Error())
+				} else {
+					store()
 				}
-			} else {
-				w.Write([]byte("no changes in packages\n"))
 			}
+		}
+
+		if !diff.lastcheck.IsZero() {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(lc.TTL.Repodiff.Seconds())))
+			w.Header().Set("X-Content-Age", time.Since(diff.lastcheck).Round(time.Second).String())
+			writeDiff(w, r, diff, releaseold, releasenew)
 		} else {
 			warn("an error occurred diffing repos",
 				"client", r.RemoteAddr,
 				"repo", repo,
 				"old release", releaseold,
-				"old mirrors", len(mirrorsold),
+				"old repos", len(sourcesold),
 				"new release", releasenew,
-				"new mirrors", len(mirrorsnew),
+				"new repos", len(sourcesnew),
 			)
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -1,26 +1,348 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// modes of checking the health of a repo
+const (
+	healthQuick  = "quick"  // compare the size of every package with what the mirror reports
+	healthDeep   = "deep"   // download every package and verify its checksum
+	healthSample = "sample" // deep check a random percentage of the packages
 )
 
-func checkHealth(uri string) (failed []string, err error) {
-	debug("repohealth", "status", "starting", "uri", uri)
+// healthcheck is how thoroughly a repohealth checks the packages.
+type healthcheck struct {
+	mode   string
+	sample int // percentage of packages checked in sample mode
+}
+
+// parseHealthCheck checks the mode and sample percentage asked for. the
+// sample percentage defaults to 10.
+func parseHealthCheck(mode string, sample int) (hc healthcheck, err error) {
+	hc = healthcheck{mode: strings.ToLower(mode), sample: sample}
+	switch hc.mode {
+	case "":
+		hc.mode = healthQuick
+	case healthQuick, healthDeep, healthSample:
+	default:
+		return hc, fmt.Errorf("mode should be one of %s, %s or %s, got %q", healthQuick, healthDeep, healthSample, mode)
+	}
+	if hc.sample == 0 {
+		hc.sample = 10
+	} else if hc.sample < 1 || hc.sample > 100 {
+		return hc, fmt.Errorf("sample should be a percentage between 1 and 100, got %d", sample)
+	}
+	return
+}
+
+// pkgcheck is what is needed to check a single package on a mirror.
+type pkgcheck struct {
+	uri      string
+	size     int
+	sumtype  string
+	checksum string
+}
+
+// identityRequest builds a request which asks the mirror not to compress
+// the response, so its length is that of the package itself.
+func identityRequest(method, uri string) (req *http.Request, err error) {
+	if req, err = http.NewRequest(method, uri, nil); err == nil {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	return
+}
+
+// encoded returns whether a mirror compressed a response anyway.
+func encoded(resp *http.Response) bool {
+	ce := resp.Header.Get("Content-Encoding")
+	return len(ce) > 0 && !strings.EqualFold(ce, "identity")
+}
+
+// remoteLength asks a mirror how large a package is without downloading it,
+// using a HEAD or, when the mirror rejects that or does not say, a GET of
+// only the first byte. encoded is true when the mirror compressed the
+// response, in which case the length is not that of the package.
+func remoteLength(lc *liveconfig, uri string) (length int64, compressed bool, err error) {
+	client := lc.clientfor(uri)
+
+	var req *http.Request
+	var resp *http.Response
+	if req, err = identityRequest("HEAD", uri); err != nil {
+		return
+	}
+	if resp, err = client.Do(req); err != nil {
+		return 0, false, fmt.Errorf("unable to fetch headers (%s)", err.Error())
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK && resp.ContentLength >= 0:
+		return resp.ContentLength, encoded(resp), nil
+	case resp.StatusCode == http.StatusOK,
+		resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusMethodNotAllowed,
+		resp.StatusCode == http.StatusNotImplemented:
+		debug("falling back to ranged request", "uri", uri, "status", resp.StatusCode)
+	default:
+		return 0, false, fmt.Errorf("unable to fetch headers for %s (status %d)", uri, resp.StatusCode)
+	}
+
+	if req, err = identityRequest("GET", uri); err != nil {
+		return
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	if resp, err = client.Do(req); err != nil {
+		return 0, false, fmt.Errorf("unable to fetch first byte (%s)", err.Error())
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// the total size is what comes after the slash in bytes 0-0/1234
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if length, err = strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				return length, encoded(resp), nil
+			}
+		}
+		return 0, false, fmt.Errorf("unable to determine size of %s (content-range %q)", uri, cr)
+	case http.StatusOK:
+		// the mirror ignored the range, but at least the length is known
+		if resp.ContentLength >= 0 {
+			return resp.ContentLength, encoded(resp), nil
+		}
+		return 0, false, fmt.Errorf("unable to determine size of %s", uri)
+	}
+	return 0, false, fmt.Errorf("unable to fetch first byte of %s (status %d)", uri, resp.StatusCode)
+}
+
+// quickCheck compares the size of a package on a mirror with the metadata.
+// packages the mirror insists on compressing can only be checked by
+// downloading them.
+func quickCheck(lc *liveconfig, c pkgcheck) error {
+	length, compressed, err := remoteLength(lc, c.uri)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		return deepCheck(lc, c, nil)
+	}
+	if length != int64(c.size) {
+		return fmt.Errorf("size mismatch for %s (size %d != %d)", c.uri, length, c.size)
+	}
+	return nil
+}
+
+// deepCheck downloads a package and verifies both its size and checksum,
+// without writing it anywhere. when there is a keyring, the signature of the
+// package is verified along the way.
+func deepCheck(lc *liveconfig, c pkgcheck, keyring openpgp.EntityList) (err error) {
+	var req *http.Request
+	var resp *http.Response
+	if req, err = identityRequest("GET", c.uri); err != nil {
+		return
+	}
+	if resp, err = lc.clientfor(c.uri).Do(req); err != nil {
+		return fmt.Errorf("unable to download %s (%s)", c.uri, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download %s (status %d)", c.uri, resp.StatusCode)
+	}
+
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(resp.Body); err != nil {
+			return fmt.Errorf("unable to decompress %s (%s)", c.uri, err.Error())
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return verifyPackage(body, c, keyring)
+}
+
+// verifyPackage reads a package to the end and verifies its size and checksum
+// against the metadata, and its signature when there is a keyring. a wrong
+// size or checksum says more than the signature failing because of it.
+func verifyPackage(r io.Reader, c pkgcheck, keyring openpgp.EntityList) (err error) {
+	h, err := newChecksum(c.sumtype)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s (%s)", c.uri, err.Error())
+	}
+
+	// everything read for the signature is hashed as well
+	var n counter
+	body := io.TeeReader(r, io.MultiWriter(h, &n))
+	var sigerr error
+	if keyring != nil {
+		if rh, e := readRPMHeader(body); e != nil {
+			sigerr = sigerror{"unable to verify " + c.uri + " (" + e.Error() + ")"}
+		} else {
+			sigerr = checkRPMSignature(keyring, c.uri, rh, body)
+		}
+	}
+
+	if _, err = io.Copy(ioutil.Discard, body); err != nil {
+		return fmt.Errorf("unable to read %s (%s)", c.uri, err.Error())
+	}
+	if int64(n) != int64(c.size) {
+		return fmt.Errorf("size mismatch for %s (size %d != %d)", c.uri, n, c.size)
+	}
+	if sum := sumOf(h); !strings.EqualFold(sum, c.checksum) {
+		return fmt.Errorf("checksum mismatch for %s (%s %s != %s)", c.uri, c.sumtype, sum, c.checksum)
+	}
+	return sigerr
+}
+
+// counter counts the bytes written to it.
+type counter int64
+
+func (c *counter) Write(b []byte) (int, error) {
+	*c += counter(len(b))
+	return len(b), nil
+}
+
+// checkData downloads a metadata file and verifies its size and checksum,
+// and those of its decompressed contents when repomd.xml lists them.
+func checkData(lc *liveconfig, uri string, d repodata) (err error) {
+	href := strings.TrimLeft(d.Location.Href, "/")
+
+	// set up the hashes first, an unknown type of checksum is a failure too
+	var h, oh hash.Hash
+	if len(d.Checksum.Text) > 0 {
+		if h, err = newChecksum(d.Checksum.Type); err != nil {
+			return fmt.Errorf("unable to verify %s (%s)", href, err.Error())
+		}
+	}
+	if len(d.OpenChecksum.Text) > 0 {
+		if oh, err = newChecksum(d.OpenChecksum.Type); err != nil {
+			return fmt.Errorf("unable to verify %s (%s)", href, err.Error())
+		}
+	}
+
+	var req *http.Request
+	var resp *http.Response
+	if req, err = identityRequest("GET", uri+"/"+href); err != nil {
+		return
+	}
+	if resp, err = lc.clientfor(uri).Do(req); err != nil {
+		return fmt.Errorf("unable to fetch %s (%s)", href, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %s (status %d)", href, resp.StatusCode)
+	}
+
+	// the file is hashed as it is read, and hashed again as it is
+	// decompressed when anything about its contents is known
+	var size, opensize counter
+	raw := []io.Writer{&size}
+	if h != nil {
+		raw = append(raw, h)
+	}
+	body := io.TeeReader(resp.Body, io.MultiWriter(raw...))
+	var openerr error
+	opened := oh != nil || len(d.OpenSize) > 0
+	if opened {
+		var rc io.ReadCloser
+		if rc, openerr = decompress(href, ioutil.NopCloser(body)); openerr == errUnsupportedCompression {
+			// only the file as it is can be verified, like zchunk metadata
+			debug("not verifying contents of metadata", "href", href, "err", openerr.Error())
+			opened, openerr = false, nil
+		} else if openerr == nil {
+			open := []io.Writer{&opensize}
+			if oh != nil {
+				open = append(open, oh)
+			}
+			_, openerr = io.Copy(io.MultiWriter(open...), rc)
+			rc.Close()
+		}
+	}
+	if _, err = io.Copy(ioutil.Discard, body); err != nil {
+		return fmt.Errorf("unable to fetch %s (%s)", href, err.Error())
+	}
+
+	// a wrong checksum says more than the decompression failing because of it
+	if len(d.Size) > 0 && d.Size != strconv.FormatInt(int64(size), 10) {
+		return fmt.Errorf("size mismatch for %s (size %d != %s)", href, size, d.Size)
+	}
+	if h != nil && !strings.EqualFold(sumOf(h), d.Checksum.Text) {
+		return fmt.Errorf("checksum mismatch for %s (%s %s != %s)", href, d.Checksum.Type, sumOf(h), d.Checksum.Text)
+	}
+	if openerr != nil {
+		return fmt.Errorf("unable to decompress %s (%s)", href, openerr.Error())
+	}
+	if !opened {
+		return nil
+	}
+	if len(d.OpenSize) > 0 && d.OpenSize != strconv.FormatInt(int64(opensize), 10) {
+		return fmt.Errorf("open size mismatch for %s (size %d != %s)", href, opensize, d.OpenSize)
+	}
+	if oh != nil && !strings.EqualFold(sumOf(oh), d.OpenChecksum.Text) {
+		return fmt.Errorf("open checksum mismatch for %s (%s %s != %s)", href, d.OpenChecksum.Type, sumOf(oh), d.OpenChecksum.Text)
+	}
+	return nil
+}
+
+// checkMetadata verifies every file listed in repomd.xml, and repomd.xml
+// itself against its signature when there are trusted keys. anything wrong
+// with them is a failure.
+func checkMetadata(lc *liveconfig, uri string, rmd *repomd) (failed, sigfailed []string) {
+	if lc.keyring != nil {
+		if e := checkRepomdSignature(lc, uri, rmd); e != nil && issigerror(e) {
+			sigfailed = append(sigfailed, e.Error())
+		} else if e != nil {
+			failed = append(failed, e.Error())
+		}
+	}
+	for _, d := range rmd.Data {
+		if e := checkData(lc, uri, d); e != nil {
+			debug("metadata verification failed", "type", d.Type, "err", e.Error())
+			failed = append(failed, e.Error())
+		}
+	}
+	return
+}
+
+// checkHealth checks the metadata of a repo and then its packages. when the
+// metadata is broken, the packages are not checked at all since they can not
+// be trusted to be what the metadata says anyway. signatures are reported
+// apart from both.
+func checkHealth(lc *liveconfig, uri string, hc healthcheck) (checked int, metafailed, failed, sigfailed []string, err error) {
+	debug("repohealth", "status", "starting", "uri", uri, "mode", hc.mode)
 	t0 := time.Now()
 
-	var c, f int
-	var pkgsmd *pkgmd
-	if pkgsmd, err = fetchPackageMetadata(uri); err != nil {
+	// the packages are read from the same repomd.xml as was verified
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
 		err = fmt.Errorf("repohealth failed: %s", err.Error())
 		return
 	}
+	if metafailed, sigfailed = checkMetadata(lc, uri, rmd); len(metafailed) > 0 {
+		debug("repohealth", "status", "metadata failed", "uri", uri, "failed", len(metafailed), "elapsed", time.Since(t0))
+		return
+	}
+	rnd := rand.New(rand.NewSource(t0.UnixNano()))
+
+	var c, f, seen int
 
-	// keep track of how many routines are running
+	// keep track of how many routines are running, and how many are allowed
 	var running int64
+	routines := int64(lc.routinesfor(uri))
 
 	// create a channel for failure feedback from routines
 	failchan := make(chan error)
@@ -29,7 +351,10 @@ func checkHealth(uri string) (failed []string, err error) {
 	// returned decrease the number of running routines by one
 	go func() {
 		for e := range failchan {
-			if e != nil {
+			if e != nil && issigerror(e) {
+				debug("package signature verification failed", "err", e.Error())
+				sigfailed = append(sigfailed, e.Error())
+			} else if e != nil {
 				debug("package verification failed", "err", e.Error())
 				failed = append(failed, e.Error())
 				f++
@@ -39,30 +364,30 @@ func checkHealth(uri string) (failed []string, err error) {
 		}
 	}()
 
-	// create a routine for each package
-	for _, p := range pkgsmd.Package {
+	// create a routine for each package as soon as it is read from the
+	// metadata
+	perr := eachPackageIn(lc, uri, rmd, func(p *primarypkg) {
+		// in sample mode, most packages are not checked at all
+		if seen++; hc.mode == healthSample && rnd.Intn(100) >= hc.sample {
+			return
+		}
+
 		// sleep for a little bit while there are enough routines running
-		for atomic.LoadInt64(&running) >= int64(fetchRoutines) {
+		for atomic.LoadInt64(&running) >= routines {
 			time.Sleep(time.Millisecond)
 		}
 
 		// increase the number of running routine by one and kick off a
 		// new routine
 		atomic.AddInt64(&running, 1)
-		go func(u string, s int) {
-			if r, e := client.Head(u); e != nil {
-				e = fmt.Errorf("unable to fetch headers (%s)", e.Error())
-				failchan <- e
+		go func(c pkgcheck) {
+			if hc.mode == healthQuick {
+				failchan <- quickCheck(lc, c)
 			} else {
-				if r.ContentLength != int64(s) {
-					e = fmt.Errorf("size mismatch for %s (size %d != %d)", u, r.ContentLength, s)
-					failchan <- e
-				} else {
-					failchan <- nil
-				}
+				failchan <- deepCheck(lc, c, lc.keyring)
 			}
-		}(uri+"/"+p.Location.Href, p.Size.Package)
-	}
+		}(pkgcheck{uri: uri + "/" + p.Location.Href, size: p.Size.Package, sumtype: p.Checksum.Type, checksum: p.Checksum.Text})
+	})
 	// while there are still routines running, take a little nap
 	for atomic.LoadInt64(&running) > 0 {
 		time.Sleep(time.Millisecond)
@@ -72,9 +397,15 @@ func checkHealth(uri string) (failed []string, err error) {
 	// can stop as well
 	close(failchan)
 
+	if perr != nil {
+		err = fmt.Errorf("repohealth failed: %s", perr.Error())
+		return
+	}
+
 	debug("repohealth", "status", "done", "uri", uri, "total", c, "failed", f, "elapsed", time.Since(t0))
 
-	if c < 1 {
+	checked = c
+	if seen < 1 {
 		err = fmt.Errorf("no packages checked for %s", uri)
 	}
 	return
@@ -84,35 +415,58 @@ func healthRequest(w http.ResponseWriter, r *http.Request) {
 	release := r.URL.Query().Get("release")
 	repo := r.URL.Query().Get("repo")
 	arch := r.URL.Query().Get("arch")
+	maintenance := r.URL.Query().Get("maintenance")
+	lc := current()
+
+	sample, _ := strconv.Atoi(r.URL.Query().Get("sample"))
+	hc, err := parseHealthCheck(r.URL.Query().Get("mode"), sample)
 
 	if len(release) < 1 || len(repo) < 1 {
 		warn("not enough parameters sent", "release", release, "repo", repo, "uri", r.RequestURI)
 		w.WriteHeader(http.StatusBadRequest)
-	} else if len(mirrors) < 1 {
+	} else if err != nil {
+		warn("invalid repohealth mode", "uri", r.RequestURI, "err", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+	} else if len(lc.mirrors) < 1 {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		if alias, ok := aliases[release]; ok {
-			release = alias
-		}
+		release = lc.resolve(release)
 
-		for _, mirror := range mirrors {
-			uri := mirror + "/" + release + "/" + repo
-			if len(arch) > 0 {
-				uri += "/" + arch
+		results := make([]checkresult, 0)
+		for _, mirror := range lc.mirrors {
+			if !mirror.serves(release, repo) {
+				continue
+			}
+			result := checkresult{Mirror: mirror.name, URI: mirror.uri(release, repo, arch), State: mirror.state}
+			if !mirror.checked(maintenance) {
+				debug("skipping mirror in maintenance", "mirror", mirror.name, "state", mirror.state)
+				result.Status = "skipped"
+				results = append(results, result)
+				continue
 			}
 
-			var failed []string
+			t0 := time.Now()
+			var metafailed, failed, sigfailed []string
 			var err error
-			if failed, err = checkHealth(uri); err != nil {
-				warn("unable to check health", "mirror", mirror, "release", release, "repo", repo, "err", err.Error())
-				w.Write([]byte(uri + " NOT CHECKED\n"))
-			} else if len(failed) > 0 {
-				warn("some packages failed check", "mirror", mirror, "release", release, "repo", repo, "failed", len(failed))
-				w.Write([]byte(uri + " " + strconv.Itoa(len(failed)) + " FAILED PACKAGES\n"))
+			result.Checked, metafailed, failed, sigfailed, err = checkHealth(lc, result.URI, hc)
+			result.SignatureFailed, result.SignatureFailures = len(sigfailed), sigfailed
+			if err != nil {
+				warn("unable to check health", "mirror", mirror.name, "release", release, "repo", repo, "err", err.Error())
+				result.Status, result.Error = "error", err.Error()
+			} else if len(metafailed) > 0 {
+				warn("some metadata failed check", "mirror", mirror.name, "release", release, "repo", repo, "failed", len(metafailed))
+				result.Status, result.MetadataFailed, result.MetadataFailures = "failed", len(metafailed), metafailed
+			} else if len(failed)+len(sigfailed) > 0 {
+				warn("some packages failed check", "mirror", mirror.name, "release", release, "repo", repo, "failed", len(failed), "signatures", len(sigfailed))
+				result.Status, result.Failed, result.Failures = "failed", len(failed), failed
 			} else {
-				info("all packages verified successfully", "mirror", mirror, "release", release, "repo", repo)
-				w.Write([]byte(uri + " OK\n"))
+				info("all packages verified successfully", "mirror", mirror.name, "release", release, "repo", repo)
+				result.Status = "ok"
 			}
+			result.Elapsed = milliseconds(time.Since(t0))
+			results = append(results, result)
 		}
+
+		writeCheckResults(w, r, results, "NOT CHECKED")
 	}
 }
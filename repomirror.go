@@ -6,18 +6,51 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+var (
+	// packages in pub which were verified against a trusted key, so they are
+	// only read again when they changed on disk or in the metadata
+	verifiedfiles = &sync.Map{}
 )
 
-func mirrorRepository(uri, repo string) (failed []string, err error) {
-	if !checkMirror(uri) {
+// verifiedfile is what a package on disk looked like when it was verified.
+type verifiedfile struct {
+	size     int64
+	mtime    time.Time
+	checksum string
+}
+
+func mirrorRepository(lc *liveconfig, uri, repo string) (checked int, failed, sigfailed []string, err error) {
+	if !checkMirror(lc, uri) {
 		err = fmt.Errorf("mirror for %s does not have valid metadata", repo)
 		return
 	}
 
+	// nothing gets mirrored from a repo with metadata which is not signed by
+	// any of the trusted keys, and the packages are read from the very same
+	// repomd.xml that was verified
+	var rmd *repomd
+	if rmd, err = fetchRepomd(lc, uri); err != nil {
+		err = fmt.Errorf("repomirror failed: %s", err.Error())
+		return
+	}
+	keyring := lc.keyring
+	if keyring != nil {
+		if err = checkRepomdSignature(lc, uri, rmd); err != nil {
+			if issigerror(err) {
+				sigfailed, err = []string{err.Error()}, nil
+			}
+			return
+		}
+	}
+
 	debug("repomirror", "status", "starting", "uri", uri)
 	t0 := time.Now()
 
@@ -27,14 +60,10 @@ func mirrorRepository(uri, repo string) (failed []string, err error) {
 	}
 
 	var c, f int
-	var pkgsmd *pkgmd
-	if pkgsmd, err = fetchPackageMetadata(uri); err != nil {
-		err = fmt.Errorf("repomirror failed: %s", err.Error())
-		return
-	}
 
-	// keep track of how many routines are running
+	// keep track of how many routines are running, and how many are allowed
 	var running int64
+	routines := int64(lc.routinesfor(uri))
 
 	// create a channel for failure feedback from routines
 	failchan := make(chan error)
@@ -43,7 +72,10 @@ func mirrorRepository(uri, repo string) (failed []string, err error) {
 	// returned decrease the number of running routines by one
 	go func() {
 		for e := range failchan {
-			if e != nil {
+			if e != nil && issigerror(e) {
+				debug("package signature failed", "err", e.Error())
+				sigfailed = append(sigfailed, e.Error())
+			} else if e != nil {
 				debug("package download failed", "err", e.Error())
 				failed = append(failed, e.Error())
 				f++
@@ -53,18 +85,20 @@ func mirrorRepository(uri, repo string) (failed []string, err error) {
 		}
 	}()
 
-	// create a routine for each package
-	for _, p := range pkgsmd.Package {
+	// create a routine for each package as soon as it is read from the
+	// metadata
+	perr := eachPackageIn(lc, uri, rmd, func(p *primarypkg) {
 		// sleep for a little bit while there are enough routines running
-		for atomic.LoadInt64(&running) >= int64(fetchRoutines) {
+		for atomic.LoadInt64(&running) >= routines {
 			time.Sleep(time.Millisecond)
 		}
 
 		// increase the number of running routine by one and kick off a
 		// new routine
 		atomic.AddInt64(&running, 1)
-		go func(u, r, h string, s int) {
-			// arguments where: u = uri, r = localrepo, h = href, and s = package size
+		go func(u, r, h string, c pkgcheck) {
+			// arguments where: u = uri, r = localrepo, h = href, and c = what the
+			// metadata says about the package
 			tn := time.Now()
 
 			// the href will have to be copied with the correct path, so split the
@@ -86,48 +120,53 @@ func mirrorRepository(uri, repo string) (failed []string, err error) {
 			// finally create a string with the full path the individual package should
 			// be downloaded to.
 			pkgpath := path.Join(repocomponents...)
+			filename := path.Join(pkgpath, pkgname)
+			c.uri = strings.TrimPrefix(filename, "pub/")
 
-			if fd, err := os.Stat(path.Join(pkgpath, pkgname)); err == nil {
-				if int64(s) == fd.Size() {
+			// a package which is already present is only kept when it still has
+			// the size the metadata says. with trusted keys it has to be signed by
+			// one of them as well, which is only checked again when the package
+			// changed since it was verified. anything else is removed so it is not
+			// served any longer
+			if fd, err := os.Stat(filename); err == nil {
+				if int64(c.size) != fd.Size() {
+					warn("repomirror", "status", "incorrect size", "package", pkgname)
+				} else if keyring == nil || isVerified(filename, fd, c) {
+					debug("repomirror", "status", "already present", "package", pkgname)
+					failchan <- nil
+					return
+				} else if err = verifyFile(filename, c, keyring); err == nil {
+					verified(lc, filename, c)
 					debug("repomirror", "status", "already present", "package", pkgname)
 					failchan <- nil
 					return
+				} else if issigerror(err) {
+					warn("repomirror", "status", "removing package", "package", pkgname, "err", err.Error())
+					os.Remove(filename)
+					failchan <- err
+					return
+				} else {
+					warn("repomirror", "status", "incorrect checksum", "package", pkgname, "err", err.Error())
 				}
-				warn("repomirror", "status", "incorrect size", "package", pkgname)
+				os.Remove(filename)
 			}
 
 			if err := os.MkdirAll(pkgpath, 0755); err != nil {
-				err = fmt.Errorf("unable to create directory for %s (%s)", pkgname, err.Error())
+				failchan <- fmt.Errorf("unable to create directory for %s (%s)", pkgname, err.Error())
+				return
+			}
+			if err := downloadPackage(lc, u+"/"+h, filename, c, keyring); err != nil {
 				failchan <- err
-			} else {
-				var resp *http.Response
-				if resp, err = client.Get(u + "/" + h); err != nil {
-					err = fmt.Errorf("unable to download package %s (%s)", pkgname, err.Error())
-					failchan <- err
-				} else {
-					defer resp.Body.Close()
-					if fh, err := os.OpenFile(path.Join(pkgpath, pkgname), os.O_RDWR|os.O_CREATE, 0644); err != nil {
-						err = fmt.Errorf("unable to write %s (%s)", pkgname, err.Error())
-						failchan <- err
-					} else {
-						var sz int64
-						if sz, err = io.Copy(fh, resp.Body); err != nil {
-							err = fmt.Errorf("failure writing package %s (%s)", pkgname, err.Error())
-							failchan <- err
-						} else if sz != int64(s) {
-							err = fmt.Errorf("written size does not match expected size for %s", pkgname)
-							failchan <- err
-						} else {
-							speed := float64(s) / 1024 / time.Since(tn).Seconds()
-							debug("repomirror", "status", "downloaded", "package", pkgname, "size", fmt.Sprintf("%.2fKB", float64(s)/1024), "speed", fmt.Sprintf("%.2fKB/s", speed))
-							failchan <- nil
-						}
-					}
-
-				}
+				return
 			}
-		}(uri, repo, p.Location.Href, p.Size.Package)
-	}
+			if keyring != nil {
+				verified(lc, filename, c)
+			}
+			speed := float64(c.size) / 1024 / time.Since(tn).Seconds()
+			debug("repomirror", "status", "downloaded", "package", pkgname, "size", fmt.Sprintf("%.2fKB", float64(c.size)/1024), "speed", fmt.Sprintf("%.2fKB/s", speed))
+			failchan <- nil
+		}(uri, repo, p.Location.Href, pkgcheck{size: p.Size.Package, sumtype: p.Checksum.Type, checksum: p.Checksum.Text})
+	})
 	// while there are still routines running, take a little nap
 	for atomic.LoadInt64(&running) > 0 {
 		time.Sleep(time.Millisecond)
@@ -137,8 +176,14 @@ func mirrorRepository(uri, repo string) (failed []string, err error) {
 	// can stop as well
 	close(failchan)
 
+	if perr != nil {
+		err = fmt.Errorf("repomirror failed: %s", perr.Error())
+		return
+	}
+
 	debug("repomirror", "status", "done", "uri", uri, "repo", repo, "total", c, "failed", f, "elapsed", time.Since(t0))
 
+	checked = c
 	if c < 1 {
 		err = fmt.Errorf("no packages checked for %s", uri)
 	}
@@ -149,21 +194,28 @@ func mirrorRequest(w http.ResponseWriter, r *http.Request) {
 	release := r.URL.Query().Get("release")
 	repo := r.URL.Query().Get("repo")
 	arch := r.URL.Query().Get("arch")
+	maintenance := r.URL.Query().Get("maintenance")
+	lc := current()
 
 	if len(release) < 1 || len(repo) < 1 {
 		warn("not enough parameters sent", "release", release, "repo", repo, "uri", r.RequestURI)
 		w.WriteHeader(http.StatusBadRequest)
-	} else if len(mirrors) < 1 {
+	} else if len(lc.mirrors) < 1 {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		if alias, ok := aliases[release]; ok {
-			release = alias
-		}
+		release = lc.resolve(release)
 
-		for _, mirror := range mirrors {
-			uri := mirror + "/" + release + "/" + repo
-			if len(arch) > 0 {
-				uri += "/" + arch
+		results := make([]checkresult, 0)
+		for _, mirror := range lc.mirrors {
+			if !mirror.serves(release, repo) {
+				continue
+			}
+			result := checkresult{Mirror: mirror.name, URI: mirror.uri(release, repo, arch), State: mirror.state}
+			if !mirror.checked(maintenance) {
+				debug("skipping mirror in maintenance", "mirror", mirror.name, "state", mirror.state)
+				result.Status = "skipped"
+				results = append(results, result)
+				continue
 			}
 
 			localrepo := release + "/" + repo
@@ -171,18 +223,82 @@ func mirrorRequest(w http.ResponseWriter, r *http.Request) {
 				localrepo += "/" + arch
 			}
 
-			var failed []string
+			t0 := time.Now()
+			var failed, sigfailed []string
 			var err error
-			if failed, err = mirrorRepository(uri, localrepo); err != nil {
-				warn("unable to mirror repo", "mirror", mirror, "release", release, "repo", repo, "err", err.Error())
-				w.Write([]byte(uri + " NOT MIRRORED\n"))
-			} else if len(failed) > 0 {
-				warn("some packages not mirrored", "mirror", mirror, "release", release, "repo", repo, "failed", len(failed))
-				w.Write([]byte(uri + " " + strconv.Itoa(len(failed)) + " FAILED PACKAGES\n"))
+			result.Checked, failed, sigfailed, err = mirrorRepository(lc, result.URI, localrepo)
+			result.SignatureFailed, result.SignatureFailures = len(sigfailed), sigfailed
+			if err != nil {
+				warn("unable to mirror repo", "mirror", mirror.name, "release", release, "repo", repo, "err", err.Error())
+				result.Status, result.Error = "error", err.Error()
+			} else if len(failed)+len(sigfailed) > 0 {
+				warn("some packages not mirrored", "mirror", mirror.name, "release", release, "repo", repo, "failed", len(failed), "signatures", len(sigfailed))
+				result.Status, result.Failed, result.Failures = "failed", len(failed), failed
 			} else {
-				info("all packages mirrored successfully", "mirror", mirror, "release", release, "repo", repo)
-				w.Write([]byte(uri + " OK\n"))
+				info("all packages mirrored successfully", "mirror", mirror.name, "release", release, "repo", repo)
+				result.Status = "ok"
 			}
+			result.Elapsed = milliseconds(time.Since(t0))
+			results = append(results, result)
 		}
+
+		writeCheckResults(w, r, results, "NOT MIRRORED")
 	}
 }
+
+// isVerified tells whether a package on disk was verified before, and did not
+// change since, neither on disk nor in the metadata.
+func isVerified(filename string, fd os.FileInfo, c pkgcheck) bool {
+	v, found := verifiedfiles.Load(filename)
+	return found && v.(verifiedfile) == verifiedfile{fd.Size(), fd.ModTime(), c.checksum}
+}
+
+// verified records that a package on disk was verified.
+func verified(lc *liveconfig, filename string, c pkgcheck) {
+	if fd, err := os.Stat(filename); err == nil {
+		lc.cache(func() { verifiedfiles.Store(filename, verifiedfile{fd.Size(), fd.ModTime(), c.checksum}) })
+	}
+}
+
+// verifyFile verifies a package on disk like a package on a mirror.
+func verifyFile(filename string, c pkgcheck, keyring openpgp.EntityList) (err error) {
+	var fh *os.File
+	if fh, err = os.Open(filename); err != nil {
+		return fmt.Errorf("unable to verify %s (%s)", c.uri, err.Error())
+	}
+	defer fh.Close()
+	return verifyPackage(fh, c, keyring)
+}
+
+// downloadPackage downloads a package next to where it should go, and only
+// moves it in place once it is verified, so a package which is incomplete,
+// corrupt or not signed by a trusted key is never served.
+func downloadPackage(lc *liveconfig, uri, filename string, c pkgcheck, keyring openpgp.EntityList) (err error) {
+	var resp *http.Response
+	if resp, err = lc.clientfor(uri).Get(uri); err != nil {
+		return fmt.Errorf("unable to download package %s (%s)", c.uri, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download package %s (status %d)", c.uri, resp.StatusCode)
+	}
+
+	partial := filename + ".part"
+	var fh *os.File
+	if fh, err = os.Create(partial); err != nil {
+		return fmt.Errorf("unable to write %s (%s)", c.uri, err.Error())
+	}
+	err = verifyPackage(io.TeeReader(resp.Body, fh), c, keyring)
+	if e := fh.Close(); e != nil && err == nil {
+		err = fmt.Errorf("unable to write %s (%s)", c.uri, e.Error())
+	}
+	if err == nil {
+		if err = os.Rename(partial, filename); err != nil {
+			err = fmt.Errorf("unable to write %s (%s)", c.uri, err.Error())
+		}
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return
+}
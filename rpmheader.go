@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// signature tags in the signature header of an rpm
+const (
+	sigtagDSA = 267  // dsa signature of the header
+	sigtagRSA = 268  // rsa signature of the header
+	sigtagPGP = 1002 // rsa signature of the header and payload
+	sigtagGPG = 1005 // dsa signature of the header and payload
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+// rpmheader is what is needed from the start of an rpm to verify its
+// signatures: the signatures by tag, and the header they are made over.
+type rpmheader struct {
+	sigs   map[uint32][]byte
+	header []byte
+}
+
+// readHeaderBlob reads a header structure as a whole, which is an intro with
+// the number of index entries and the size of the data, the index entries and
+// the data they point into.
+func readHeaderBlob(r io.Reader) (blob []byte, nindex, hsize uint32, err error) {
+	intro := make([]byte, 16)
+	if _, err = io.ReadFull(r, intro); err != nil {
+		return
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		err = fmt.Errorf("bad header magic")
+		return
+	}
+	nindex, hsize = binary.BigEndian.Uint32(intro[8:12]), binary.BigEndian.Uint32(intro[12:16])
+	if nindex > 1<<16 || hsize > 1<<26 {
+		err = fmt.Errorf("header too large (%d entries, %d bytes)", nindex, hsize)
+		return
+	}
+	blob = make([]byte, 16+16*int(nindex)+int(hsize))
+	copy(blob, intro)
+	_, err = io.ReadFull(r, blob[16:])
+	return
+}
+
+// readRPMHeader reads the lead, signature header and header from the start
+// of an rpm, leaving r at the payload.
+func readRPMHeader(r io.Reader) (h rpmheader, err error) {
+	lead := make([]byte, 96)
+	if _, err = io.ReadFull(r, lead); err != nil {
+		return h, fmt.Errorf("unable to read rpm lead (%s)", err.Error())
+	}
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return h, fmt.Errorf("not an rpm")
+	}
+
+	var sig []byte
+	var nindex, hsize uint32
+	if sig, nindex, hsize, err = readHeaderBlob(r); err != nil {
+		return h, fmt.Errorf("unable to read rpm signature header (%s)", err.Error())
+	}
+	// the signature header is padded to a multiple of 8 bytes
+	if pad := (8 - hsize%8) % 8; pad > 0 {
+		if _, err = io.ReadFull(r, make([]byte, pad)); err != nil {
+			return h, fmt.Errorf("unable to read rpm signature header (%s)", err.Error())
+		}
+	}
+
+	h.sigs = make(map[uint32][]byte)
+	store := sig[16+16*nindex:]
+	for i := uint32(0); i < nindex; i++ {
+		entry := sig[16+16*i : 32+16*i]
+		tag, offset, count := binary.BigEndian.Uint32(entry[0:4]), binary.BigEndian.Uint32(entry[8:12]), binary.BigEndian.Uint32(entry[12:16])
+		switch tag {
+		case sigtagDSA, sigtagRSA, sigtagPGP, sigtagGPG:
+			if uint64(offset)+uint64(count) > uint64(len(store)) {
+				return h, fmt.Errorf("rpm signature header is corrupt")
+			}
+			h.sigs[tag] = store[offset : offset+count]
+		}
+	}
+
+	if h.header, _, _, err = readHeaderBlob(r); err != nil {
+		return h, fmt.Errorf("unable to read rpm header (%s)", err.Error())
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testdata/signed.rpm has a signature of its header, testdata/pgp.rpm one of
+// its header and payload, both by the key in testdata/RPM-GPG-KEY-test. the
+// payload of both is the bytes 0 to 199.
+func testPayload() []byte {
+	payload := make([]byte, 200)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+// readTestHeader splits an rpm in its headers and whatever follows them.
+func readTestHeader(b []byte) (h rpmheader, rest []byte, err error) {
+	err = recovered(func() (err error) {
+		r := bytes.NewReader(b)
+		if h, err = readRPMHeader(r); err == nil {
+			rest, err = ioutil.ReadAll(r)
+		}
+		return
+	})
+	return
+}
+
+func TestRPMHeader(t *testing.T) {
+	keyring, err := loadKeyring([]string{"testdata/RPM-GPG-KEY-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		tag  uint32
+	}{
+		{"signed.rpm", sigtagRSA},
+		{"pgp.rpm", sigtagPGP},
+	} {
+		h, rest, err := readTestHeader(readTestdata(t, test.name))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if len(h.sigs) != 1 || len(h.sigs[test.tag]) < 1 {
+			t.Errorf("%s: expected only a signature with tag %d, got %d signatures", test.name, test.tag, len(h.sigs))
+		}
+		if !bytes.HasPrefix(h.header, rpmHeaderMagic) {
+			t.Errorf("%s: header does not start with the header magic", test.name)
+		}
+		if !bytes.Equal(rest, testPayload()) {
+			t.Errorf("%s: not left at the payload, %d bytes left", test.name, len(rest))
+		}
+
+		if err = checkRPMSignature(keyring, test.name, h, bytes.NewReader(rest)); err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+		if err = checkRPMSignature(nil, test.name, h, bytes.NewReader(rest)); !issigerror(err) {
+			t.Errorf("%s: no signature error without any trusted keys, got %v", test.name, err)
+		}
+	}
+
+	// a header signature does not cover the payload, a pgp signature does
+	h, rest, _ := readTestHeader(readTestdata(t, "pgp.rpm"))
+	rest[0] ^= 0xff
+	if err = checkRPMSignature(keyring, "pgp.rpm", h, bytes.NewReader(rest)); !issigerror(err) {
+		t.Errorf("pgp.rpm with another payload: expected a signature error, got %v", err)
+	}
+	h, _, _ = readTestHeader(readTestdata(t, "signed.rpm"))
+	h.header[len(h.header)-2] ^= 0xff
+	if err = checkRPMSignature(keyring, "signed.rpm", h, nil); !issigerror(err) {
+		t.Errorf("signed.rpm with another header: expected a signature error, got %v", err)
+	}
+	if err = checkRPMSignature(keyring, "unsigned.rpm", rpmheader{}, nil); !issigerror(err) {
+		t.Errorf("rpm without signatures: expected a signature error, got %v", err)
+	}
+}
+
+func TestRPMHeaderCorrupt(t *testing.T) {
+	// the signature header starts right after the lead, and its index right
+	// after its intro of 16 bytes
+	const sig, index = 96, 96 + 16
+	put32 := func(at int, v uint32) func(b []byte) []byte {
+		return func(b []byte) []byte { binary.BigEndian.PutUint32(b[at:], v); return b }
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"empty", func(b []byte) []byte { return nil }},
+		{"truncated lead", func(b []byte) []byte { return b[:50] }},
+		{"only the lead", func(b []byte) []byte { return b[:sig] }},
+		{"truncated signature intro", func(b []byte) []byte { return b[:sig+10] }},
+		{"truncated signature index", func(b []byte) []byte { return b[:index+8] }},
+		{"truncated signature data", func(b []byte) []byte { return b[:index+16+20] }},
+		{"truncated header", func(b []byte) []byte { return b[:len(b)-200-10] }},
+		{"not an rpm", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"bad signature header magic", func(b []byte) []byte { b[sig] = 'X'; return b }},
+		{"too many signature entries", put32(sig+8, 1<<20)},
+		{"signature data too large", put32(sig+12, 1<<30)},
+		{"signature past the data", put32(index+8, 1<<20)},
+		{"signature longer than the data", put32(index+12, 1<<20)},
+		{"signature wrapping around", func(b []byte) []byte {
+			put32(index+8, 0xfffffff0)(b)
+			return put32(index+12, 0x20)(b)
+		}},
+		{"bad header magic", func(b []byte) []byte {
+			h, _, _ := readTestHeader(readTestdata(t, "signed.rpm"))
+			b[len(b)-200-len(h.header)] = 'X'
+			return b
+		}},
+	}
+	for _, test := range tests {
+		b := test.corrupt(readTestdata(t, "signed.rpm"))
+		if _, _, err := readTestHeader(b); err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if strings.HasPrefix(err.Error(), "panic") {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+	}
+
+	// garbage anywhere in the lead or the headers is either read like any
+	// other value or refused, whichever byte it replaces
+	for _, name := range []string{"signed.rpm", "pgp.rpm"} {
+		orig := readTestdata(t, name)
+		for i := 0; i < len(orig)-200; i++ {
+			for _, v := range []byte{0x00, 0x7f, 0xff} {
+				b := append([]byte(nil), orig...)
+				b[i] = v
+				if _, _, err := readTestHeader(b); err != nil && strings.HasPrefix(err.Error(), "panic") {
+					t.Fatalf("%s: byte %d set to %#x: %s", name, i, v, err.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+)
+
+// rpmvercmp compares two version (or release) strings the way rpm does. it
+// returns 1 if a is newer, -1 if b is newer and 0 if they are equal.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	isalpha := func(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+	isdigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isalnum := func(c byte) bool { return isalpha(c) || isdigit(c) }
+
+	for len(a) > 0 || len(b) > 0 {
+		// skip over anything which is not a letter, digit or tilde/caret
+		for len(a) > 0 && !isalnum(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isalnum(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+
+		// a tilde sorts before anything, even the end of a string
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		// a caret sorts after the end of a string, but before anything else
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		// grab a segment of either only digits or only letters from both
+		numeric := isdigit(a[0])
+		is := isalpha
+		if numeric {
+			is = isdigit
+		}
+		var i, j int
+		for i < len(a) && is(a[i]) {
+			i++
+		}
+		for j < len(b) && is(b[j]) {
+			j++
+		}
+		sa, sb := a[:i], b[:j]
+		a, b = a[i:], b[j:]
+
+		// segments of a different type, numeric is always newer
+		if len(sb) == 0 {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			sa = strings.TrimLeft(sa, "0")
+			sb = strings.TrimLeft(sb, "0")
+			// the longer number (without leading zeros) is the larger one
+			if len(sa) > len(sb) {
+				return 1
+			} else if len(sa) < len(sb) {
+				return -1
+			}
+		}
+
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+	}
+
+	// whichever string has anything left is the newer one
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) > 0 {
+		return 1
+	}
+	return -1
+}
+
+// evrcmp compares two packages by epoch, version and release, in that order.
+// an empty epoch is the same as an epoch of 0.
+func evrcmp(epoch1, ver1, rel1, epoch2, ver2, rel2 string) int {
+	if epoch1 == "" {
+		epoch1 = "0"
+	}
+	if epoch2 == "" {
+		epoch2 = "0"
+	}
+	if c := rpmvercmp(epoch1, epoch2); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(ver1, ver2); c != 0 {
+		return c
+	}
+	return rpmvercmp(rel1, rel2)
+}
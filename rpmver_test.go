@@ -0,0 +1,163 @@
+package main
+
+import "testing"
+
+// the cases are those rpm itself tests rpmvercmp with, in tests/rpmvercmp.at
+func TestRpmvercmp(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0", "1.0", 1},
+
+		{"2.0.1", "2.0.1", 0},
+		{"2.0", "2.0.1", -1},
+		{"2.0.1", "2.0", 1},
+
+		{"2.0.1a", "2.0.1a", 0},
+		{"2.0.1a", "2.0.1", 1},
+		{"2.0.1", "2.0.1a", -1},
+
+		{"5.5p1", "5.5p1", 0},
+		{"5.5p1", "5.5p2", -1},
+		{"5.5p2", "5.5p1", 1},
+
+		{"5.5p10", "5.5p10", 0},
+		{"5.5p1", "5.5p10", -1},
+		{"5.5p10", "5.5p1", 1},
+
+		{"10xyz", "10.1xyz", -1},
+		{"10.1xyz", "10xyz", 1},
+
+		{"xyz10", "xyz10", 0},
+		{"xyz10", "xyz10.1", -1},
+		{"xyz10.1", "xyz10", 1},
+
+		{"xyz.4", "xyz.4", 0},
+		{"xyz.4", "8", -1},
+		{"8", "xyz.4", 1},
+		{"xyz.4", "2", -1},
+		{"2", "xyz.4", 1},
+
+		{"5.5p2", "5.6p1", -1},
+		{"5.6p1", "5.5p2", 1},
+
+		{"5.6p1", "6.5p1", -1},
+		{"6.5p1", "5.6p1", 1},
+
+		{"6.0.rc1", "6.0", 1},
+		{"6.0", "6.0.rc1", -1},
+
+		{"10b2", "10a1", 1},
+		{"10a2", "10b2", -1},
+
+		{"1.0aa", "1.0aa", 0},
+		{"1.0a", "1.0aa", -1},
+		{"1.0aa", "1.0a", 1},
+
+		{"10.0001", "10.0001", 0},
+		{"10.0001", "10.1", 0},
+		{"10.1", "10.0001", 0},
+		{"10.0001", "10.0039", -1},
+		{"10.0039", "10.0001", 1},
+
+		{"4.999.9", "5.0", -1},
+		{"5.0", "4.999.9", 1},
+
+		{"20101121", "20101121", 0},
+		{"20101121", "20101122", -1},
+		{"20101122", "20101121", 1},
+
+		{"2_0", "2_0", 0},
+		{"2.0", "2_0", 0},
+		{"2_0", "2.0", 0},
+
+		{"a", "a", 0},
+		{"a+", "a+", 0},
+		{"a+", "a_", 0},
+		{"a_", "a+", 0},
+		{"+a", "+a", 0},
+		{"+a", "_a", 0},
+		{"_a", "+a", 0},
+		{"+_", "+_", 0},
+		{"_+", "+_", 0},
+		{"_+", "_+", 0},
+		{"+", "_", 0},
+		{"_", "+", 0},
+
+		{"1.0~rc1", "1.0~rc1", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0~rc1", 1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc2", "1.0~rc1", 1},
+		{"1.0~rc1~git123", "1.0~rc1~git123", 0},
+		{"1.0~rc1~git123", "1.0~rc1", -1},
+		{"1.0~rc1", "1.0~rc1~git123", 1},
+
+		{"1.0^", "1.0^", 0},
+		{"1.0^", "1.0", 1},
+		{"1.0", "1.0^", -1},
+		{"1.0^git1", "1.0^git1", 0},
+		{"1.0^git1", "1.0", 1},
+		{"1.0", "1.0^git1", -1},
+		{"1.0^git1", "1.0^git2", -1},
+		{"1.0^git2", "1.0^git1", 1},
+		{"1.0^git1", "1.01", -1},
+		{"1.01", "1.0^git1", 1},
+		{"1.0^20160101", "1.0^20160101", 0},
+		{"1.0^20160101", "1.0.1", -1},
+		{"1.0.1", "1.0^20160101", 1},
+		{"1.0^20160101^git1", "1.0^20160101^git1", 0},
+		{"1.0^20160102", "1.0^20160101^git1", 1},
+		{"1.0^20160101^git1", "1.0^20160102", -1},
+
+		{"1.0~rc1^git1", "1.0~rc1^git1", 0},
+		{"1.0~rc1^git1", "1.0~rc1", 1},
+		{"1.0~rc1", "1.0~rc1^git1", -1},
+
+		{"1.0^git1~pre", "1.0^git1~pre", 0},
+		{"1.0^git1", "1.0^git1~pre", 1},
+		{"1.0^git1~pre", "1.0^git1", -1},
+
+		// not in rpm's tests, but what repos are full of
+		{"", "", 0},
+		{"1", "", 1},
+		{"", "1", -1},
+		{"4.2.46", "4.2.46", 0},
+		{"30.el7", "31.el7", -1},
+		{"31.el7", "30.el7", 1},
+		{"1.el7_9", "1.el7", 1},
+		{"1.el7", "1.el7_9", -1},
+		{"1.el7.centos", "1.el7", 1},
+		{"99999999999999999999", "99999999999999999998", 1},
+	}
+	for _, test := range tests {
+		if got := rpmvercmp(test.a, test.b); got != test.expect {
+			t.Errorf("rpmvercmp(%q, %q) = %d, expected %d", test.a, test.b, got, test.expect)
+		}
+	}
+}
+
+func TestEvrcmp(t *testing.T) {
+	tests := []struct {
+		e1, v1, r1 string
+		e2, v2, r2 string
+		expect     int
+	}{
+		{"0", "1.0", "1", "0", "1.0", "1", 0},
+		{"", "1.0", "1", "0", "1.0", "1", 0},
+		{"0", "1.0", "1", "", "1.0", "1", 0},
+		{"1", "1.0", "1", "0", "2.0", "1", 1},
+		{"0", "2.0", "1", "1", "1.0", "1", -1},
+		{"0", "1.0", "2", "0", "1.0", "10", -1},
+		{"0", "1.1", "1", "0", "1.0", "99", 1},
+		{"2", "1.0", "1", "10", "1.0", "1", -1},
+	}
+	for _, test := range tests {
+		if got := evrcmp(test.e1, test.v1, test.r1, test.e2, test.v2, test.r2); got != test.expect {
+			t.Errorf("evrcmp(%s:%s-%s, %s:%s-%s) = %d, expected %d", test.e1, test.v1, test.r1, test.e2, test.v2, test.r2, got, test.expect)
+		}
+	}
+}
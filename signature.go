@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+// sigerror is content which is not signed, or not signed by any of the
+// trusted keys. these are reported apart from other failures.
+type sigerror struct {
+	msg string
+}
+
+func (e sigerror) Error() string {
+	return e.msg
+}
+
+// issigerror returns whether an error is about a signature.
+func issigerror(err error) bool {
+	var se sigerror
+	return errors.As(err, &se)
+}
+
+// loadKeyring reads the trusted public keys, from files which are either
+// armored or not.
+func loadKeyring(files []string) (keyring openpgp.EntityList, err error) {
+	for _, filename := range files {
+		var b []byte
+		if b, err = ioutil.ReadFile(filename); err != nil {
+			return nil, fmt.Errorf("unable to read gpg key %s (%s)", filename, err.Error())
+		}
+
+		var keys openpgp.EntityList
+		if bytes.Contains(b, []byte("-----BEGIN PGP")) {
+			keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		} else {
+			keys, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gpg key %s (%s)", filename, err.Error())
+		} else if len(keys) < 1 {
+			return nil, fmt.Errorf("no keys found in %s", filename)
+		}
+		keyring = append(keyring, keys...)
+	}
+	return
+}
+
+// checkSignature verifies a detached signature over data, telling apart
+// signatures by keys which are not trusted from signatures which are wrong.
+func checkSignature(keyring openpgp.EntityList, what string, data io.Reader, sig io.Reader, armored bool) error {
+	var err error
+	if armored {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, data, sig, nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, data, sig, nil)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return sigerror{what + " is signed with an untrusted key"}
+	}
+	return sigerror{"bad signature for " + what + " (" + err.Error() + ")"}
+}
+
+// checkRepomdSignature verifies repomd.xml, exactly as it was fetched and
+// parsed, against its detached signature in repomd.xml.asc. a repo without
+// one only fails when signatures are required.
+func checkRepomdSignature(lc *liveconfig, uri string, rmd *repomd) error {
+	resp, err := lc.clientfor(uri).Get(uri + "/repodata/repomd.xml.asc")
+	if err != nil {
+		return fmt.Errorf("unable to fetch repomd.xml.asc (%s)", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		if lc.GPG.Require {
+			return sigerror{uri + "/repodata/repomd.xml is not signed"}
+		}
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch repomd.xml.asc (status %d)", resp.StatusCode)
+	}
+
+	var sig []byte
+	if sig, err = ioutil.ReadAll(resp.Body); err != nil {
+		return fmt.Errorf("unable to fetch repomd.xml.asc (%s)", err.Error())
+	}
+	return checkSignature(lc.keyring, uri+"/repodata/repomd.xml", bytes.NewReader(rmd.raw), bytes.NewReader(sig), true)
+}
+
+// checkRPMSignature verifies the signature of an rpm against the trusted keys.
+// a signature of just the header is preferred, older rpms only have one of
+// the header and payload, in which case the rest of the package is read from
+// payload.
+func checkRPMSignature(keyring openpgp.EntityList, what string, h rpmheader, payload io.Reader) error {
+	for _, tag := range []uint32{sigtagRSA, sigtagDSA} {
+		if sig, found := h.sigs[tag]; found {
+			return checkSignature(keyring, what, bytes.NewReader(h.header), bytes.NewReader(sig), false)
+		}
+	}
+	for _, tag := range []uint32{sigtagPGP, sigtagGPG} {
+		if sig, found := h.sigs[tag]; found {
+			return checkSignature(keyring, what, io.MultiReader(bytes.NewReader(h.header), payload), bytes.NewReader(sig), false)
+		}
+	}
+	return sigerror{what + " is not signed"}
+}
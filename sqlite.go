@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// sqlitedb is a minimal, read-only reader of the sqlite file format. it can
+// only scan whole tables, which is all that is needed to read the metadata
+// databases of a repo, and keeps repogirl free of cgo.
+type sqlitedb struct {
+	r        io.ReaderAt
+	pagesize int
+	usable   int
+	tables   map[string]sqlitetable
+}
+
+type sqlitetable struct {
+	root    int
+	columns map[string]int
+	rowid   int // index of the INTEGER PRIMARY KEY column, or -1 if none
+}
+
+// sqliterow is a single row of a table, which can be asked for its values by
+// column name.
+type sqliterow struct {
+	table  *sqlitetable
+	values []interface{}
+}
+
+// openSqlite reads the header and schema of a sqlite database.
+func openSqlite(r io.ReaderAt) (db *sqlitedb, err error) {
+	header := make([]byte, 100)
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("unable to read sqlite header (%s)", err.Error())
+	}
+	if !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		return nil, fmt.Errorf("unable to read sqlite header (not a sqlite database)")
+	}
+	if enc := binary.BigEndian.Uint32(header[56:]); enc > 1 {
+		return nil, fmt.Errorf("unable to read sqlite database (text encoding %d is not supported)", enc)
+	}
+
+	db = &sqlitedb{r: r, pagesize: int(binary.BigEndian.Uint16(header[16:])), tables: make(map[string]sqlitetable)}
+	if db.pagesize == 1 {
+		db.pagesize = 65536
+	}
+	// the page size is a power of two between 512 and 65536, of which at
+	// least 480 bytes are usable
+	if db.pagesize < 512 || db.pagesize&(db.pagesize-1) != 0 {
+		return nil, fmt.Errorf("unable to read sqlite header (bad page size %d)", db.pagesize)
+	}
+	if db.usable = db.pagesize - int(header[20]); db.usable < 480 {
+		return nil, fmt.Errorf("unable to read sqlite header (bad reserved space %d)", header[20])
+	}
+
+	// the schema is a table itself, kept on the first page
+	schema := &sqlitetable{root: 1, columns: map[string]int{"type": 0, "name": 1, "tbl_name": 2, "rootpage": 3, "sql": 4}, rowid: -1}
+	err = db.scanTable(schema, func(row sqliterow) error {
+		if row.text("type") == "table" {
+			db.tables[row.text("name")] = parseCreateTable(row.text("sql"), int(row.int("rootpage")))
+		}
+		return nil
+	})
+	return
+}
+
+// parseCreateTable takes the column names from the CREATE TABLE statement of
+// a table.
+func parseCreateTable(sql string, root int) (t sqlitetable) {
+	t = sqlitetable{root: root, columns: make(map[string]int), rowid: -1}
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return
+	}
+
+	// split the column definitions on the commas which are not nested
+	var defs []string
+	var depth, last int
+	body := sql[start+1 : end]
+	for i, c := range body {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, body[last:i])
+				last = i + 1
+			}
+		}
+	}
+	defs = append(defs, body[last:])
+
+	for _, def := range defs {
+		fields := strings.Fields(def)
+		if len(fields) < 1 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "CONSTRAINT":
+			continue
+		}
+		name := strings.Trim(fields[0], "\"`[]")
+		if strings.Contains(strings.ToUpper(def), "INTEGER PRIMARY KEY") {
+			t.rowid = len(t.columns)
+		}
+		t.columns[name] = len(t.columns)
+	}
+	return
+}
+
+// scan calls each for every row in a table.
+func (db *sqlitedb) scan(table string, each func(row sqliterow) error) error {
+	t, found := db.tables[table]
+	if !found {
+		return fmt.Errorf("unable to find table %s", table)
+	}
+	return db.scanTable(&t, each)
+}
+
+func (db *sqlitedb) scanTable(t *sqlitetable, each func(row sqliterow) error) error {
+	return db.scanPage(t, t.root, 0, make(map[int]bool), each)
+}
+
+// scanPage walks the b-tree of a table from a page down, depth first so rows
+// come out in rowid order. pages which were seen before mean the tree loops.
+func (db *sqlitedb) scanPage(t *sqlitetable, pgno, depth int, seen map[int]bool, each func(row sqliterow) error) (err error) {
+	if depth > 64 {
+		return fmt.Errorf("unable to read sqlite page %d (tree too deep)", pgno)
+	}
+	if seen[pgno] {
+		return fmt.Errorf("unable to read sqlite page %d (page used twice)", pgno)
+	}
+	seen[pgno] = true
+	var page []byte
+	if page, err = db.page(pgno); err != nil {
+		return
+	}
+
+	// the first page starts with the database header
+	offset := 0
+	if pgno == 1 {
+		offset = 100
+	}
+	hdr := page[offset:]
+
+	// the page header is 12 bytes on interior pages and 8 on leaf pages,
+	// followed by a pointer of 2 bytes to every cell
+	var hdrsize int
+	switch hdr[0] {
+	case 0x05:
+		hdrsize = 12
+	case 0x0d:
+		hdrsize = 8
+	default:
+		return fmt.Errorf("unable to read sqlite page %d (unexpected page type %d)", pgno, hdr[0])
+	}
+	ncells := int(binary.BigEndian.Uint16(hdr[3:]))
+	if hdrsize+2*ncells > len(hdr) {
+		return fmt.Errorf("unable to read sqlite page %d (too many cells)", pgno)
+	}
+	pointers := hdr[hdrsize:]
+
+	// cellat returns the offset of a cell, which has to leave room for at
+	// least min bytes on the page
+	cellat := func(i, min int) (int, error) {
+		cell := int(binary.BigEndian.Uint16(pointers[i*2:]))
+		if cell < offset+hdrsize || cell+min > len(page) {
+			return 0, fmt.Errorf("unable to read sqlite page %d (bad cell offset)", pgno)
+		}
+		return cell, nil
+	}
+
+	if hdr[0] == 0x05 { // interior page of a table
+		for i := 0; i < ncells; i++ {
+			var cell int
+			if cell, err = cellat(i, 4); err != nil {
+				return
+			}
+			if err = db.scanPage(t, int(binary.BigEndian.Uint32(page[cell:])), depth+1, seen, each); err != nil {
+				return
+			}
+		}
+		return db.scanPage(t, int(binary.BigEndian.Uint32(hdr[8:])), depth+1, seen, each)
+	}
+
+	// leaf page of a table
+	for i := 0; i < ncells; i++ {
+		var cell int
+		if cell, err = cellat(i, 1); err != nil {
+			return
+		}
+		size, n := sqliteVarint(page[cell:])
+		rowid, m := sqliteVarint(page[cell+n:])
+		if n == 0 || m == 0 || size > math.MaxInt32 {
+			return fmt.Errorf("unable to read sqlite page %d (bad cell)", pgno)
+		}
+		var payload []byte
+		if payload, err = db.payload(page, cell+n+m, int(size)); err != nil {
+			return
+		}
+		var values []interface{}
+		if values, err = sqliteRecord(payload); err != nil {
+			return fmt.Errorf("unable to read sqlite page %d (%s)", pgno, err.Error())
+		}
+		if t.rowid >= 0 && t.rowid < len(values) && values[t.rowid] == nil {
+			values[t.rowid] = int64(rowid)
+		}
+		if err = each(sqliterow{table: t, values: values}); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (db *sqlitedb) page(pgno int) (page []byte, err error) {
+	if pgno < 1 {
+		return nil, fmt.Errorf("unable to read sqlite page %d (bad page number)", pgno)
+	}
+	page = make([]byte, db.pagesize)
+	if _, err = db.r.ReadAt(page, int64(pgno-1)*int64(db.pagesize)); err != nil {
+		err = fmt.Errorf("unable to read sqlite page %d (%s)", pgno, err.Error())
+	}
+	return
+}
+
+// payload returns the payload of a cell on a leaf page, following the chain
+// of overflow pages for payloads which do not fit on the page itself.
+func (db *sqlitedb) payload(page []byte, offset, size int) (payload []byte, err error) {
+	local := size
+	if max := db.usable - 35; size > max {
+		min := (db.usable-12)*32/255 - 23
+		local = min + (size-min)%(db.usable-4)
+		if local > max {
+			local = min
+		}
+	}
+	if offset+local > len(page) {
+		return nil, fmt.Errorf("unable to read sqlite payload (cell too large)")
+	}
+	payload = append(make([]byte, 0, local), page[offset:offset+local]...)
+	if local == size {
+		return
+	}
+
+	if offset+local+4 > len(page) {
+		return nil, fmt.Errorf("unable to read sqlite payload (cell too large)")
+	}
+	next := int(binary.BigEndian.Uint32(page[offset+local:]))
+	seen := make(map[int]bool)
+	for len(payload) < size && next > 0 {
+		if seen[next] {
+			return nil, fmt.Errorf("unable to read sqlite payload (overflow chain loops)")
+		}
+		seen[next] = true
+		var overflow []byte
+		if overflow, err = db.page(next); err != nil {
+			return
+		}
+		next = int(binary.BigEndian.Uint32(overflow))
+		n := size - len(payload)
+		if n > db.usable-4 {
+			n = db.usable - 4
+		}
+		payload = append(payload, overflow[4:4+n]...)
+	}
+	if len(payload) < size {
+		err = fmt.Errorf("unable to read sqlite payload (overflow chain too short)")
+	}
+	return
+}
+
+// sqliteVarint decodes a variable length integer, returning its value and
+// how many bytes it took.
+func sqliteVarint(b []byte) (v uint64, n int) {
+	for n < 8 && n < len(b) {
+		v = v<<7 | uint64(b[n]&0x7f)
+		n++
+		if b[n-1] < 0x80 {
+			return
+		}
+	}
+	if n < len(b) {
+		v = v<<8 | uint64(b[n])
+		n++
+	}
+	return
+}
+
+// sqliteRecord decodes the values of a record.
+func sqliteRecord(b []byte) (values []interface{}, err error) {
+	hdrsize, n := sqliteVarint(b)
+	if hdrsize > uint64(len(b)) || n == 0 {
+		return nil, fmt.Errorf("bad record header")
+	}
+
+	var types []uint64
+	for pos := n; pos < int(hdrsize); {
+		t, m := sqliteVarint(b[pos:])
+		if m == 0 {
+			return nil, fmt.Errorf("bad record header")
+		}
+		types = append(types, t)
+		pos += m
+	}
+
+	data := b[hdrsize:]
+	for _, t := range types {
+		var size int
+		switch {
+		case t == 0, t == 8, t == 9:
+			size = 0
+		case t <= 4:
+			size = int(t)
+		case t == 5:
+			size = 6
+		case t == 6, t == 7:
+			size = 8
+		case t >= 12:
+			if (t-12)/2 > uint64(len(data)) {
+				return nil, fmt.Errorf("record too short")
+			}
+			size = int(t-12) / 2
+		default:
+			return nil, fmt.Errorf("bad serial type %d", t)
+		}
+		if size > len(data) {
+			return nil, fmt.Errorf("record too short")
+		}
+		field := data[:size]
+		data = data[size:]
+
+		switch {
+		case t == 0:
+			values = append(values, nil)
+		case t == 8:
+			values = append(values, int64(0))
+		case t == 9:
+			values = append(values, int64(1))
+		case t == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(field)))
+		case t <= 6:
+			// big-endian two's complement of any size up to 8 bytes
+			var v int64
+			if field[0]&0x80 != 0 {
+				v = -1
+			}
+			for _, c := range field {
+				v = v<<8 | int64(c)
+			}
+			values = append(values, v)
+		case t%2 == 0:
+			values = append(values, field)
+		default:
+			values = append(values, string(field))
+		}
+	}
+	return
+}
+
+// text returns the value of a column as a string, or an empty string if the
+// table has no such column or the value is NULL.
+func (r sqliterow) text(column string) string {
+	i, found := r.table.columns[column]
+	if !found || i >= len(r.values) {
+		return ""
+	}
+	switch v := r.values[i].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// int returns the value of a column as an integer, or 0 if the table has no
+// such column or the value is not an integer.
+func (r sqliterow) int(column string) int64 {
+	i, found := r.table.columns[column]
+	if !found || i >= len(r.values) {
+		return 0
+	}
+	if v, ok := r.values[i].(int64); ok {
+		return v
+	}
+	return 0
+}
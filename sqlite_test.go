@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// readTestdata reads a file from testdata.
+func readTestdata(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// recovered returns the error of f, or its panic as an error starting with
+// "panic", so tests of corrupt input can tell a parser that noticed from one
+// that crashed.
+func recovered(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+// testdata/primary.sqlite has 60 packages with a description of i*i/3 bytes,
+// on pages of 1024 bytes so the tables have interior pages and the longest
+// descriptions overflow. the packages table is rooted on page 3.
+func readTestDB(t *testing.T) []byte {
+	return readTestdata(t, "primary.sqlite")
+}
+
+// scanTestDB reads every table of a database.
+func scanTestDB(b []byte) (rows int, err error) {
+	err = recovered(func() error {
+		db, err := openSqlite(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"packages", "requires"} {
+			if err = db.scan(table, func(row sqliterow) error {
+				rows++
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func TestSqliteScan(t *testing.T) {
+	db, err := openSqlite(bytes.NewReader(readTestDB(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err = db.scan("packages", func(row sqliterow) error {
+		n++
+		name := fmt.Sprintf("pkg%03d", n)
+		if got := row.text("name"); got != name {
+			t.Errorf("row %d: name %q, expected %q", n, got, name)
+		}
+		if got := row.int("pkgKey"); got != int64(n) {
+			t.Errorf("row %d: pkgKey %d, expected %d", n, got, n)
+		}
+		if got := row.int("size_package"); got != int64(n*1000) {
+			t.Errorf("row %d: size_package %d, expected %d", n, got, n*1000)
+		}
+		if got, expect := row.text("description"), strings.Repeat("d", n*n/3); got != expect {
+			t.Errorf("row %d: description of %d bytes, expected %d", n, len(got), len(expect))
+		}
+		if got := row.text("nosuchcolumn"); got != "" {
+			t.Errorf("row %d: unknown column gave %q", n, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 60 {
+		t.Errorf("scanned %d packages, expected 60", n)
+	}
+
+	if err = db.scan("nosuchtable", func(row sqliterow) error { return nil }); err == nil {
+		t.Errorf("scanning an unknown table did not fail")
+	}
+}
+
+func TestSqliteCorrupt(t *testing.T) {
+	const pagesize = 1024
+	put16 := func(at int, v uint16) func(b []byte) {
+		return func(b []byte) { binary.BigEndian.PutUint16(b[at:], v) }
+	}
+	put32 := func(at int, v uint32) func(b []byte) {
+		return func(b []byte) { binary.BigEndian.PutUint32(b[at:], v) }
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"empty", func(b []byte) []byte { return nil }},
+		{"truncated header", func(b []byte) []byte { return b[:50] }},
+		{"truncated first page", func(b []byte) []byte { return b[:200] }},
+		{"truncated halfway", func(b []byte) []byte { return b[:len(b)/2] }},
+		{"truncated last page", func(b []byte) []byte { return b[:len(b)-10] }},
+		{"not sqlite", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"page size too small", func(b []byte) []byte { put16(16, 256)(b); return b }},
+		{"page size not a power of two", func(b []byte) []byte { put16(16, 1000)(b); return b }},
+		{"reserved space too large", func(b []byte) []byte { b[20] = 255; return b }},
+		{"too many cells on schema page", func(b []byte) []byte { put16(100+3, 0xffff)(b); return b }},
+		{"too many cells on interior page", func(b []byte) []byte { put16(2*pagesize+3, 0xffff)(b); return b }},
+		{"too many cells on leaf page", func(b []byte) []byte { put16(4*pagesize+3, 0xffff)(b); return b }},
+		{"cell pointers past the page", func(b []byte) []byte {
+			// every pointer leads to the same tiny but valid cell inside the
+			// pointer array itself, one more pointer would be past the page
+			page := b[4*pagesize : 5*pagesize]
+			for i := 8; i < pagesize; i += 2 {
+				put16(i, 0x0101)(page)
+			}
+			put16(3, (pagesize-8)/2+1)(page)
+			return b
+		}},
+		{"cell past the page", func(b []byte) []byte { put16(4*pagesize+8, 0xfff0)(b); return b }},
+		{"cell in the page header", func(b []byte) []byte { put16(4*pagesize+8, 2)(b); return b }},
+		{"child past the end", func(b []byte) []byte { put32(2*pagesize+8, 0xffffff)(b); return b }},
+		{"child page zero", func(b []byte) []byte { put32(2*pagesize+8, 0)(b); return b }},
+		{"tree loops", func(b []byte) []byte { put32(2*pagesize+8, 3)(b); return b }},
+		{"unknown page type", func(b []byte) []byte { b[4*pagesize] = 0x42; return b }},
+	}
+	for _, test := range tests {
+		b := test.corrupt(readTestDB(t))
+		if _, err := scanTestDB(b); err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if strings.HasPrefix(err.Error(), "panic") {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+	}
+
+	// any byte of the file can be garbage, which may or may not be noticed,
+	// but never panics
+	orig := readTestDB(t)
+	for i := 0; i < len(orig); i += 11 {
+		for _, v := range []byte{0x00, 0xff} {
+			b := append([]byte(nil), orig...)
+			b[i] = v
+			if _, err := scanTestDB(b); err != nil && strings.HasPrefix(err.Error(), "panic") {
+				t.Fatalf("byte %d set to %#x: %s", i, v, err.Error())
+			}
+		}
+	}
+}
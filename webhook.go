@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// events webhooks can be sent for
+const (
+	eventMirrorUnhealthy = "mirror.unhealthy" // a repo on a mirror stopped answering
+	eventMirrorHealthy   = "mirror.healthy"   // and started answering again
+	eventMirrorStale     = "mirror.stale"     // a repo on a mirror is behind the other mirrors
+	eventRevision        = "repomd.revision"  // a repo on a mirror has a new repomd.xml revision
+	eventAliasChanged    = "alias.changed"    // an alias points to another release
+	eventJobFailed       = "job.failed"       // a job had errors or failed packages
+	eventPing            = "ping"             // sent when testing a webhook
+)
+
+var (
+	webhookevents = []string{eventMirrorUnhealthy, eventMirrorHealthy, eventMirrorStale, eventRevision, eventAliasChanged, eventJobFailed, eventPing}
+
+	// repos on mirrors which were found to be stale, so that is only sent
+	// once until they catch up
+	stalemirrors = &sync.Map{}
+
+	// time to wait before the first retry, doubling with every next one
+	webhookbackoff = time.Second
+
+	// events waiting to be delivered, by name of the webhook
+	webhookqueues = &sync.Map{}
+)
+
+// events which can wait for a webhook, newer events are dropped while the
+// queue of a webhook is full
+const webhookqueue = 100
+
+// webhookconfig defines where events are posted to.
+type webhookconfig struct {
+	Name    string        `yaml:"name"`
+	URL     string        `yaml:"url"`
+	Secret  string        `yaml:"secret"`  // signs the payloads with hmac-sha256 if set
+	Events  []string      `yaml:"events"`  // patterns like "mirror.*", all events when empty
+	Retries *int          `yaml:"retries"` // defaults to 3
+	Timeout time.Duration `yaml:"timeout"` // for a single delivery, defaults to 5s
+	TLS     struct {
+		InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	} `yaml:"tls"`
+	Proxy string `yaml:"proxy"` // the settings of the mirrors do not apply to webhooks
+}
+
+func (wh *webhookconfig) validate() error {
+	if len(wh.Name) < 1 {
+		return fmt.Errorf("a name is required")
+	}
+	if u, err := url.Parse(wh.URL); err != nil {
+		return fmt.Errorf("invalid url %q (%s)", wh.URL, err.Error())
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q should start with http:// or https:// and have a host", wh.URL)
+	}
+	for _, p := range wh.Events {
+		if !matchknown(p) {
+			return fmt.Errorf("events: %q does not match any of %v", p, webhookevents)
+		}
+	}
+	if wh.Retries == nil {
+		retries := 3
+		wh.Retries = &retries
+	} else if *wh.Retries < 0 {
+		return fmt.Errorf("retries can not be negative")
+	}
+	if wh.Proxy != "" {
+		if _, err := url.Parse(wh.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy %q (%s)", wh.Proxy, err.Error())
+		}
+	}
+	if wh.Timeout == 0 {
+		wh.Timeout = time.Second * 5
+	} else if wh.Timeout < 0 {
+		return fmt.Errorf("timeout can not be negative")
+	}
+	return nil
+}
+
+// matchknown returns whether a pattern matches any of the known events.
+func matchknown(pattern string) bool {
+	for _, e := range webhookevents {
+		if matchany([]string{pattern}, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// wants returns whether a webhook is interested in an event. pings always
+// get sent, otherwise a webhook could not be tested.
+func (wh *webhookconfig) wants(event string) bool {
+	return event == eventPing || matchany(wh.Events, event)
+}
+
+// webhookevent is the payload posted to webhooks.
+type webhookevent struct {
+	ID    string                 `json:"id"`
+	Event string                 `json:"event"`
+	Time  time.Time              `json:"time"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+func newWebhookEvent(event string, data map[string]interface{}) (e webhookevent) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return webhookevent{ID: hex.EncodeToString(b), Event: event, Time: time.Now().UTC(), Data: data}
+}
+
+// sign returns the signature of a payload, which receivers can check by
+// computing the hmac-sha256 of the body with the same secret.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify queues an event for every webhook which wants it, to be posted in
+// the background.
+func notify(event string, data map[string]interface{}) {
+	lc := current()
+	if len(lc.Webhooks) < 1 {
+		return
+	}
+
+	e := newWebhookEvent(event, data)
+	body, err := json.Marshal(e)
+	if err != nil {
+		warn("unable to encode webhook event", "event", event, "err", err.Error())
+		return
+	}
+
+	for _, wh := range lc.Webhooks {
+		if wh.wants(event) {
+			enqueue(webhookdelivery{lc, wh, e, body})
+		}
+	}
+}
+
+// webhookdelivery is an event waiting to be delivered to a webhook.
+type webhookdelivery struct {
+	lc   *liveconfig
+	wh   webhookconfig
+	e    webhookevent
+	body []byte
+}
+
+// enqueue hands an event to the routine of its webhook, which delivers the
+// events one at a time and in order, so a slow receiver does not pile up
+// routines.
+func enqueue(d webhookdelivery) {
+	q, found := webhookqueues.Load(d.wh.Name)
+	if !found {
+		var loaded bool
+		if q, loaded = webhookqueues.LoadOrStore(d.wh.Name, make(chan webhookdelivery, webhookqueue)); !loaded {
+			go func(q chan webhookdelivery) {
+				for d := range q {
+					deliver(d.lc, d.wh, d.e, d.body)
+				}
+			}(q.(chan webhookdelivery))
+		}
+	}
+
+	select {
+	case q.(chan webhookdelivery) <- d:
+	default:
+		warn("webhook not delivered, too many events waiting", "webhook", d.wh.Name, "event", d.e.Event, "id", d.e.ID)
+	}
+}
+
+// deliver posts an event to a webhook, retrying with an increasing backoff
+// when it could not be delivered. only server errors and rate limiting are
+// worth another try, other errors from the receiver are final.
+func deliver(lc *liveconfig, wh webhookconfig, e webhookevent, body []byte) (status int, err error) {
+	backoff := webhookbackoff
+	for attempt := 0; ; attempt++ {
+		if status, err = post(lc, wh, e, body); err == nil && status < 300 {
+			debug("webhook delivered", "webhook", wh.Name, "event", e.Event, "id", e.ID, "status", status, "attempt", attempt+1)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("unable to deliver webhook (status %d)", status)
+		}
+		if attempt >= *wh.Retries || (status > 0 && status < 500 && status != http.StatusTooManyRequests) {
+			warn("webhook not delivered", "webhook", wh.Name, "event", e.Event, "id", e.ID, "attempts", attempt+1, "err", err.Error())
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// post does a single delivery of an event.
+func post(lc *liveconfig, wh webhookconfig, e webhookevent, body []byte) (status int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wh.Timeout)
+	defer cancel()
+
+	var req *http.Request
+	if req, err = http.NewRequest("POST", wh.URL, bytes.NewReader(body)); err != nil {
+		return 0, fmt.Errorf("unable to build webhook request (%s)", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "repogirl/"+version)
+	req.Header.Set("X-Repogirl-Event", e.Event)
+	req.Header.Set("X-Repogirl-Delivery", e.ID)
+	if len(wh.Secret) > 0 {
+		req.Header.Set("X-Repogirl-Signature", sign(wh.Secret, body))
+	}
+
+	var resp *http.Response
+	if resp, err = lc.webhookclients[wh.Name].Do(req.WithContext(ctx)); err != nil {
+		return 0, fmt.Errorf("unable to deliver webhook (%s)", err.Error())
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// webhookfor returns the configuration of a webhook by name.
+func (lc *liveconfig) webhookfor(name string) *webhookconfig {
+	for i := range lc.Webhooks {
+		if lc.Webhooks[i].Name == name {
+			return &lc.Webhooks[i]
+		}
+	}
+	return nil
+}
+
+// checkStale sends an event for every mirror in a mirrorlist which has an
+// older revision of the repo than the newest one on any of the mirrors.
+// revisions which can not be compared to it do not make a mirror stale.
+func checkStale(results []mirrorresult) {
+	for _, m := range results {
+		if m.Status != "ok" || len(m.Revision) < 1 {
+			continue
+		}
+		newest := m.Revision
+		for _, o := range results {
+			if cmp, ok := compareRevisions(newest, o.Revision); o.Status == "ok" && ok && cmp < 0 {
+				newest = o.Revision
+			}
+		}
+
+		_, wasstale := stalemirrors.Load(m.URI)
+		if newest == m.Revision {
+			stalemirrors.Delete(m.URI)
+		} else if !wasstale {
+			stalemirrors.Store(m.URI, true)
+			info("mirror is behind the other mirrors", "mirror", m.Mirror, "uri", m.URI, "revision", m.Revision, "newest", newest)
+			notify(eventMirrorStale, map[string]interface{}{"mirror": m.Mirror, "uri": m.URI, "revision": m.Revision, "newest": newest})
+		}
+	}
+}
+
+// webhookRequest sends a ping to a webhook and reports how that went, to
+// test a receiver without waiting for an actual event.
+func webhookRequest(w http.ResponseWriter, r *http.Request, lc *liveconfig, name string) {
+	wh := lc.webhookfor(name)
+	if wh == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	e := newWebhookEvent(eventPing, map[string]interface{}{"webhook": wh.Name})
+	body, _ := json.Marshal(e)
+	status, err := deliver(lc, *wh, e, body)
+
+	reply := map[string]interface{}{"webhook": wh.Name, "id": e.ID, "status": status, "delivered": err == nil}
+	if err != nil {
+		reply["error"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
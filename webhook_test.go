@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhooks returns a configuration with a webhook for each of the given
+// ones, all posting to srv.
+func testWebhooks(t *testing.T, srv *httptest.Server, webhooks ...webhookconfig) *liveconfig {
+	lc := &liveconfig{config: &config{}, webhookclients: make(map[string]*http.Client)}
+	for _, wh := range webhooks {
+		wh.URL = srv.URL + "/" + wh.Name
+		if err := wh.validate(); err != nil {
+			t.Fatal(err)
+		}
+		lc.Webhooks = append(lc.Webhooks, wh)
+		lc.webhookclients[wh.Name] = srv.Client()
+	}
+	return lc
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		events []string
+		event  string
+		wants  bool
+	}{
+		{nil, eventMirrorStale, true},
+		{nil, eventJobFailed, true},
+		{[]string{"mirror.*"}, eventMirrorUnhealthy, true},
+		{[]string{"mirror.*"}, eventMirrorStale, true},
+		{[]string{"mirror.*"}, eventRevision, false},
+		{[]string{"mirror.*", "job.failed"}, eventJobFailed, true},
+		{[]string{"alias.changed"}, eventAliasChanged, true},
+		{[]string{"alias.changed"}, eventMirrorHealthy, false},
+		{[]string{"alias.changed"}, eventPing, true},
+	}
+	for _, test := range tests {
+		wh := webhookconfig{Events: test.events}
+		if wants := wh.wants(test.event); wants != test.wants {
+			t.Errorf("webhook for %v wants %s = %v, expected %v", test.events, test.event, wants, test.wants)
+		}
+	}
+}
+
+func TestWebhookSign(t *testing.T) {
+	var got http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	lc := testWebhooks(t, srv, webhookconfig{Name: "signed", Secret: "s3cret"}, webhookconfig{Name: "unsigned"})
+	e := newWebhookEvent(eventPing, map[string]interface{}{"webhook": "signed"})
+	b, _ := json.Marshal(e)
+
+	if _, err := deliver(lc, lc.Webhooks[0], e, b); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if signature := got.Get("X-Repogirl-Signature"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %q does not match the body", signature)
+	}
+	if got.Get("X-Repogirl-Event") != eventPing || got.Get("X-Repogirl-Delivery") != e.ID {
+		t.Errorf("event %q and delivery %q, expected %q and %q", got.Get("X-Repogirl-Event"), got.Get("X-Repogirl-Delivery"), eventPing, e.ID)
+	}
+
+	if _, err := deliver(lc, lc.Webhooks[1], e, b); err != nil {
+		t.Fatal(err)
+	}
+	if signature := got.Get("X-Repogirl-Signature"); signature != "" {
+		t.Errorf("signature %q without a secret", signature)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer func(backoff time.Duration) { webhookbackoff = backoff }(webhookbackoff)
+	webhookbackoff = time.Millisecond
+
+	tests := []struct {
+		statuses  []int // replied to the attempts, the last one from then on
+		attempts  int
+		delivered bool
+	}{
+		{[]int{200}, 1, true},
+		{[]int{204}, 1, true},
+		{[]int{500, 502, 200}, 3, true},
+		{[]int{503}, 4, false},
+		{[]int{429, 200}, 2, true},
+		{[]int{429}, 4, false},
+		{[]int{400}, 1, false},
+		{[]int{404}, 1, false},
+		{[]int{500, 403, 200}, 2, false},
+	}
+	for _, test := range tests {
+		var attempts int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := test.statuses[len(test.statuses)-1]
+			if attempts < len(test.statuses) {
+				status = test.statuses[attempts]
+			}
+			attempts++
+			w.WriteHeader(status)
+		}))
+
+		lc := testWebhooks(t, srv, webhookconfig{Name: "retried"})
+		e := newWebhookEvent(eventJobFailed, nil)
+		_, err := deliver(lc, lc.Webhooks[0], e, []byte("{}"))
+		srv.Close()
+
+		if attempts != test.attempts {
+			t.Errorf("%v: %d attempts, expected %d", test.statuses, attempts, test.attempts)
+		}
+		if delivered := err == nil; delivered != test.delivered {
+			t.Errorf("%v: delivered = %v, expected %v", test.statuses, delivered, test.delivered)
+		}
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	var lock sync.Mutex
+	received := make(map[string][]string)
+	done := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], r.Header.Get("X-Repogirl-Event"))
+		lock.Unlock()
+		done <- true
+	}))
+	defer srv.Close()
+
+	lc := testWebhooks(t, srv, webhookconfig{Name: "mirrors", Events: []string{"mirror.*"}}, webhookconfig{Name: "aliases", Events: []string{"alias.changed"}})
+	if old := live.Load(); old != nil {
+		defer live.Store(old)
+	}
+	live.Store(lc)
+
+	for _, event := range []string{eventMirrorUnhealthy, eventAliasChanged, eventRevision, eventMirrorHealthy} {
+		notify(event, nil)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of 3 events delivered", i)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got := received["/mirrors"]; len(got) != 2 || got[0] != eventMirrorUnhealthy || got[1] != eventMirrorHealthy {
+		t.Errorf("mirrors webhook got %v, expected [%s %s]", got, eventMirrorUnhealthy, eventMirrorHealthy)
+	}
+	if got := received["/aliases"]; len(got) != 1 || got[0] != eventAliasChanged {
+		t.Errorf("aliases webhook got %v, expected [%s]", got, eventAliasChanged)
+	}
+}